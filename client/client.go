@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2016, TEECOM
+ *
+ * This code is provided for free, as is, under the MIT license
+ * (see LICENSE.md).
+ */
+
+// Package client posts arrival times to a Lobby Transit DIY server, so
+// feeders don't each have to speak the update API themselves.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a request may take unless the caller supplies its own http.Client
+const DefaultTimeout = 10 * time.Second
+
+// Most of an error response that is kept for StatusError
+const maxErrorBody = 4 << 10
+
+// Returned when the server refuses the API key
+var ErrUnauthorized = errors.New("client: missing or invalid API key")
+
+// Returned when the update is larger than the server accepts
+var ErrTooLarge = errors.New("client: update too large")
+
+// Returned when the server rejected an update it could read; Errors lists
+// every problem it found
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return "client: update rejected: " + strings.Join(e.Errors, "; ")
+}
+
+// Returned when the client is posting faster than the server allows.
+// RetryAfter is zero if the server didn't say.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("client: rate limited; retry after %s", e.RetryAfter)
+	}
+	return "client: rate limited"
+}
+
+// Returned for any other unsuccessful response. Body is the server's
+// message, if it gave one.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// New times for one line at a station. TimesAbs, if set, takes precedence
+// over Times on the server. LineName is only used when LineID is empty,
+// and must match exactly one line in that direction.
+type LineUpdate struct {
+	LineID   string  `json:"lineID"`
+	LineName string  `json:"lineName,omitempty"`
+	Index    int     `json:"index"`
+	Times    []int   `json:"times"`
+	TimesAbs []int64 `json:"timesAbs,omitempty"`
+}
+
+// New times for any number of lines at one station
+type StationUpdate struct {
+	StationID string       `json:"stationID"`
+	Lines     []LineUpdate `json:"lines"`
+}
+
+// A whole update, as posted to /update
+type Update struct {
+	Stops []StationUpdate `json:"stops"`
+}
+
+// Build a line update from minutes until each arrival
+func Line(lineID string, index int, times ...int) LineUpdate {
+	if times == nil {
+		times = []int{}
+	}
+	return LineUpdate{LineID: lineID, Index: index, Times: times}
+}
+
+// Build a line update for a line known only by name
+func LineNamed(name string, index int, times ...int) LineUpdate {
+	if times == nil {
+		times = []int{}
+	}
+	return LineUpdate{LineName: name, Index: index, Times: times}
+}
+
+// Build a line update from arrival times, which are sent as Unix timestamps
+func LineAt(lineID string, index int, times ...time.Time) LineUpdate {
+	abs := make([]int64, len(times))
+	for i, t := range times {
+		abs[i] = t.Unix()
+	}
+	return LineUpdate{LineID: lineID, Index: index, Times: []int{}, TimesAbs: abs}
+}
+
+// Build a station update from its lines
+func Station(stationID string, lines ...LineUpdate) StationUpdate {
+	if lines == nil {
+		lines = []LineUpdate{}
+	}
+	return StationUpdate{StationID: stationID, Lines: lines}
+}
+
+// Build an update from its stations
+func NewUpdate(stops ...StationUpdate) Update {
+	if stops == nil {
+		stops = []StationUpdate{}
+	}
+	return Update{Stops: stops}
+}
+
+// Posts updates to one system on a server
+type Client struct {
+	// Where the system is served, e.g. "http://localhost:8080" or, when the
+	// server hosts several systems, "http://localhost:8080/lobby"
+	BaseURL string
+
+	// Sent as X-API-Key when set; must match the server's -updateKey
+	Key string
+
+	// Used for every request; New sets one with DefaultTimeout
+	HTTPClient *http.Client
+}
+
+// Create a client for the system at baseURL
+func New(baseURL, key string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Key:        key,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Post an update. Nothing is applied unless the error is nil.
+func (c *Client) ApplyUpdate(ctx context.Context, u Update) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(c.BaseURL, "/")+"/update", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Key != "" {
+		req.Header.Set("X-API-Key", c.Key)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return responseError(resp)
+}
+
+// Turn an unsuccessful response into one of the typed errors
+func responseError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case http.StatusTooManyRequests:
+		var retryAfter time.Duration
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	// Rejected updates list their problems; other errors carry one message
+	msg := strings.TrimSpace(string(body))
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var rejected struct {
+			Error  string   `json:"error"`
+			Detail string   `json:"detail"`
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(body, &rejected); err == nil {
+			if resp.StatusCode == http.StatusBadRequest && len(rejected.Errors) > 0 {
+				return &ValidationError{Errors: rejected.Errors}
+			}
+			if rejected.Error != "" {
+				msg = rejected.Error
+				if rejected.Detail != "" {
+					msg += ": " + rejected.Detail
+				}
+			}
+		}
+	}
+
+	return &StatusError{StatusCode: resp.StatusCode, Body: msg}
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TEECOM/lobby-transit-diy/internal/server"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+const testConfig = `{"name":"Test","tagline":"t","timeMax":45,"stops":[
+{"name":"Café Central","id":"cafe","coord":{"lat":37.78,"lon":-122.41},"directions":["N","S"],"lines":[{"red":{"name":"Red","id":"red","color":"#f00"},"blue":{"name":"Blue","id":"blue","color":"#00f"}},{"red":{"name":"Red","id":"red","color":"#f00"}}]}
+]}`
+
+// Serve the test configuration with the real handlers and the given
+// flags, returning the server's URL
+func startServer(t *testing.T, flags ...string) string {
+	t.Helper()
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := server.NewHandler(config, append([]string{"-staticDir=../static"}, flags...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// The times the server has for a line at the test station
+func times(t *testing.T, url, lineID string, index int) []int {
+	t.Helper()
+	resp, err := http.Get(url + "/stop?id=cafe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var stop struct {
+		Lines [2]map[string]struct {
+			Times []int `json:"times"`
+		} `json:"lines"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stop); err != nil {
+		t.Fatal(err)
+	}
+	return stop.Lines[index][lineID].Times
+}
+
+func TestApplyUpdate(t *testing.T) {
+	url := startServer(t, "-updateKey=sekrit")
+	c := New(url, "sekrit")
+	soon := time.Now().Add(5*time.Minute + 30*time.Second)
+	err := c.ApplyUpdate(context.Background(), NewUpdate(Station("cafe",
+		Line("red", 0, 9, 3),
+		LineNamed("Blue", 0, 4),
+		LineAt("red", 1, soon),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		lineID string
+		index  int
+		want   []int
+	}{
+		{"red", 0, []int{3, 9}},
+		{"blue", 0, []int{4}},
+		{"red", 1, []int{5}},
+	} {
+		if got := times(t, url, tc.lineID, tc.index); !slices.Equal(got, tc.want) {
+			t.Errorf("%s in direction %d: got %v, want %v", tc.lineID, tc.index, got, tc.want)
+		}
+	}
+}
+
+func TestBaseURLTrailingSlash(t *testing.T) {
+	url := startServer(t)
+	for _, c := range []*Client{New(url+"/", ""), {BaseURL: url + "/"}} {
+		if err := c.ApplyUpdate(context.Background(), NewUpdate(Station("cafe", Line("red", 0, 7)))); err != nil {
+			t.Errorf("BaseURL %q: %v", c.BaseURL, err)
+		}
+	}
+	if got := times(t, url, "red", 0); !slices.Equal(got, []int{7}) {
+		t.Errorf("got %v, want [7]", got)
+	}
+}
+
+func TestErrUnauthorized(t *testing.T) {
+	url := startServer(t, "-updateKey=sekrit")
+	for _, key := range []string{"", "guess"} {
+		err := New(url, key).ApplyUpdate(context.Background(), NewUpdate(Station("cafe", Line("red", 0, 3))))
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("key %q: got %v, want ErrUnauthorized", key, err)
+		}
+	}
+	if got := times(t, url, "red", 0); len(got) != 0 {
+		t.Errorf("an unauthorized update was applied: %v", got)
+	}
+}
+
+func TestErrTooLarge(t *testing.T) {
+	url := startServer(t, "-maxBody=64")
+	err := New(url, "").ApplyUpdate(context.Background(), NewUpdate(Station("cafe", Line("red", 0, 1, 2, 3, 4, 5, 6, 7, 8))))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	url := startServer(t)
+	err := New(url, "").ApplyUpdate(context.Background(), NewUpdate(
+		Station("nowhere", Line("red", 0, 3)),
+		Station("cafe", Line("purple", 0, 3), Line("red", 0, 3)),
+	))
+
+	var rejected *ValidationError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	want := []string{"Invalid station ID (nowhere)", "Invalid line ID (purple) for station cafe, index 0"}
+	if !reflect.DeepEqual(rejected.Errors, want) {
+		t.Errorf("got %q, want %q", rejected.Errors, want)
+	}
+	if got := times(t, url, "red", 0); len(got) != 0 {
+		t.Errorf("part of a rejected update was applied: %v", got)
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	url := startServer(t, "-updateRate=0.5", "-updateBurst=1")
+	c := New(url, "")
+	u := NewUpdate(Station("cafe", Line("red", 0, 3)))
+	if err := c.ApplyUpdate(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+
+	var limited *RateLimitError
+	if err := c.ApplyUpdate(context.Background(), u); !errors.As(err, &limited) {
+		t.Fatalf("got %v, want a RateLimitError", err)
+	}
+	if limited.RetryAfter != 2*time.Second {
+		t.Errorf("got RetryAfter %v, want 2s", limited.RetryAfter)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	url := startServer(t)
+	err := New(url+"/elsewhere", "").ApplyUpdate(context.Background(), NewUpdate())
+
+	var status *StatusError
+	if !errors.As(err, &status) {
+		t.Fatalf("got %v, want a StatusError", err)
+	}
+	if status.StatusCode != http.StatusNotFound || status.Body != "404 page not found" {
+		t.Errorf("got %d %q", status.StatusCode, status.Body)
+	}
+}
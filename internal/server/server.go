@@ -0,0 +1,5728 @@
+/*
+ * Copyright (c) 2016, TEECOM
+ *
+ * This code is provided for free, as is, under the MIT license
+ * (see LICENSE.md).
+ */
+
+// Package server is the transit information server: its handlers, the
+// feeds it polls, and Main, which runs it as the ltdiy command does.
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+)
+
+// Strucures; the actual information is separated from updates
+type line struct {
+	Name     string  `json:"name" msgpack:"name"`
+	ID       string  `json:"id" msgpack:"id"`
+	Times    []int   `json:"times" msgpack:"times"`
+	TimesAbs []int64 `json:"timesAbs,omitempty" msgpack:"timesAbs,omitempty"` // Unix seconds, when the feeder sent them
+	Color    string  `json:"color" msgpack:"color"`
+
+	Display []string `json:"display,omitempty" msgpack:"display,omitempty"` // Times formatted for boards, such as "Due" and "5 min"; only in responses
+
+	Destination string `json:"destination" msgpack:"destination"` // Where the line is headed from here; optional
+
+	Order int `json:"order,omitempty" msgpack:"order,omitempty"` // Position among the direction's lines; optional, lines without one go last
+
+	absolute  bool      // TimesAbs came from the feeder, so Times are worked out from them when read
+	updatedAt time.Time // Last update to the times; not moved by -countdown
+}
+
+type coordinates struct {
+	Lat float64 `json:"lat" msgpack:"lat"`
+	Lon float64 `json:"lon" msgpack:"lon"`
+}
+
+type station struct {
+	sync.RWMutex // Protects the contents of Lines; taken after the system lock
+
+	Name  string      `json:"name"`
+	ID    string      `json:"id"`
+	Coord coordinates `json:"coord"`
+	Alert string      `json:"alert,omitempty"` // Service alert shown for the station, such as a closed elevator
+
+	OutOfService bool `json:"outOfService,omitempty"` // Closed, such as during construction; protected by the system lock
+
+	Sequence int `json:"sequence,omitempty"` // Position in /info; optional, stations without one go last
+
+	Directions [2]string `json:"directions"`
+
+	Lines [2]map[string]*line `json:"lines"`
+}
+
+// The system lock protects its structure: which stations and lines
+// exist, and what they are called. Arrival times belong to each
+// station's own lock, which may only be taken while holding the
+// system lock (for reading is enough), and only in the order stations
+// appear in Stops. Holding the system write lock therefore excludes
+// everything else.
+type system struct {
+	sync.RWMutex            // Protects everything below
+	Name         string     `json:"name"`
+	Tagline      string     `json:"tagline"`
+	Alert        string     `json:"alert,omitempty"` // Service alert shown for the whole system
+	Stops        []*station `json:"stops"`
+	TimeMax      int        `json:"timeMax"`
+	stopMap      map[string]*station
+	loaded       bool // Whether a configuration has been installed
+
+	version    atomic.Uint64 // Bumped whenever anything changes
+	modified   atomic.Int64  // When anything last changed, in Unix nanoseconds
+	lastUpdate atomic.Int64  // When an update was last applied, in Unix nanoseconds
+
+	infoMu      sync.Mutex // Protects the cached /info body; taken after the system lock
+	info        []byte
+	infoVersion uint64
+
+	tickMu   sync.Mutex // Protects nextTick; taken after the system lock, before station locks
+	nextTick int64      // When minutes worked out from timestamps next change, in Unix seconds; 0 if never
+
+	subMu       sync.Mutex // Protects subscribers; taken after the system lock, before station locks
+	subscribers map[*subscriber]bool
+
+	bufferMu sync.Mutex      // Protects buffered; never held with the other locks
+	buffered []stationUpdate // Accepted updates waiting for -coalesce, oldest first
+}
+
+// A client listening for updates, optionally to a single station
+type subscriber struct {
+	stationID string
+	events    chan streamEvent
+}
+
+// What subscribers are sent: a "snapshot" of everything they follow,
+// when they start following it or the structure changes, and then a
+// "delta" with just the stations and lines each change touched
+type streamEvent struct {
+	kind string
+	data []byte
+}
+
+// Stations touched by a change, for deltas to the whole system
+type systemDelta struct {
+	Stops []*stationSnapshot `json:"stops"`
+}
+
+// Update structures (externally generated)
+type lineUpdate struct {
+	LineID   string  `json:"lineID"`
+	LineName string  `json:"lineName,omitempty"` // Used to find the line when LineID is empty
+	Index    int     `json:"index"`
+	Times    []int   `json:"times"`
+	TimesAbs []int64 `json:"timesAbs"` // Takes precedence over Times
+}
+
+type stationUpdate struct {
+	StationID string       `json:"stationID"`
+	Lines     []lineUpdate `json:"lines"`
+}
+
+type update struct {
+	Stops []stationUpdate `json:"stops"`
+}
+
+// Outcome of an update: what it changed or, if it was rejected, every
+// problem found
+type updateSummary struct {
+	StationsUpdated int      `json:"stationsUpdated"`
+	LinesUpdated    int      `json:"linesUpdated"`
+	DryRun          bool     `json:"dryRun,omitempty"` // Nothing was actually changed
+	Queued          bool     `json:"queued,omitempty"` // Accepted, but waiting for -coalesce to apply it
+	Errors          []string `json:"errors,omitempty"` // Why it was rejected, up to maxUpdateErrors
+
+	system  string        // Name of the system updated, for the audit log
+	changed []changedLine // Every line updated, for the audit log
+}
+
+// A line changed by an update
+type changedLine struct {
+	StationID string `json:"stationID"`
+	LineID    string `json:"lineID"`
+	Index     int    `json:"index"`
+}
+
+// An accepted update, as recorded in the audit log
+type auditEntry struct {
+	Time       time.Time     `json:"time"`
+	Event      string        `json:"event"`                // "applied", or "queued" for -coalesce to apply later
+	RemoteAddr string        `json:"remoteAddr,omitempty"` // Left out for coalesced updates, which may merge several clients'
+	System     string        `json:"system"`
+	Lines      []changedLine `json:"lines"`
+}
+
+// A system served by this process
+type hostedSystem struct {
+	name   string // Route prefix; empty when it is the only system
+	source string // Where the configuration comes from
+	load   func() (*system, error)
+	sys    *system
+}
+
+// Every system being served, main system first
+var systems []*hostedSystem
+
+// This is the main system information; at runtime this is filled
+// in by the supplied configuration file. Feeds, update files and
+// webhooks all belong to it.
+var mainSystem system = system{
+	stopMap:     make(map[string]*station),
+	subscribers: make(map[*subscriber]bool),
+}
+
+// Request and update statistics, exposed at /metrics
+type metrics struct {
+	requests       *prometheus.CounterVec // By handler and result
+	updateDuration prometheus.Histogram
+	staleEvents    prometheus.Counter // Times the stale watchdog has fired
+	stale          prometheus.Gauge
+
+	handler http.Handler // Serves everything registered
+}
+
+// Upper bounds of the update duration histogram, in seconds
+var updateBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// Register the server's metrics with a registry of their own, so
+// /metrics shows only those
+func newMetrics() *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ltdiy_requests_total",
+			Help: "Requests handled, by handler and result.",
+		}, []string{"handler", "result"}),
+		updateDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ltdiy_update_duration_seconds",
+			Help:    "Time spent processing updates.",
+			Buckets: updateBuckets,
+		}),
+		staleEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ltdiy_stale_total",
+			Help: "Times updates stopped arriving for longer than -staleAfter.",
+		}),
+		stale: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ltdiy_stale",
+			Help: "Whether updates have currently stopped arriving.",
+		}),
+	}
+
+	// Sizes come straight from the systems when scraped
+	stations := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ltdiy_stations",
+		Help: "Stations in the system.",
+	}, func() float64 {
+		stations, _ := systemSizes()
+		return float64(stations)
+	})
+	lines := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ltdiy_lines",
+		Help: "Lines in the system, counted once per station and direction.",
+	}, func() float64 {
+		_, lines := systemSizes()
+		return float64(lines)
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.requests, m.updateDuration, m.staleEvents, m.stale, stations, lines)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+var mainMetrics *metrics = newMetrics()
+
+// When the server started
+var startTime time.Time = time.Now()
+
+// Distinguishes versions from one run of the server to the next
+var epoch int64 = startTime.UnixNano()
+
+// Build information, passed on by the ltdiy command
+var (
+	version   string = "dev"
+	commit    string = "none"
+	buildDate string = "unknown"
+)
+
+// Where static files will be found
+var staticDirectory string
+
+// Key required in the X-API-Key header of updates; when empty,
+// updates are accepted from anyone
+var updateKey string
+
+// Key required by /debug/config instead of the update key, so ops can
+// look without being able to post updates
+var debugKey string
+
+// Whether large responses may be gzip compressed
+var gzipEnabled bool
+
+// Whether read endpoints leave out stations that are out of service,
+// rather than showing them flagged
+var hideOutOfService bool
+
+// Whether updates for stations that are out of service are accepted
+// without being applied
+var ignoreOutOfService bool
+
+// Payload served by /info and /stop to clients that don't ask for one:
+// 1 for only the original fields, 2 for everything
+var apiVersion int
+
+// Whether /info and /stop honor ?callback= for JSONP
+var allowJSONP bool
+
+// JSONP callbacks must be plain JavaScript identifiers
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+
+// Most times accepted for a single line in an update; zero means
+// no limit
+var maxTimes int
+
+// Origins allowed to make cross-origin requests; "*" allows any.
+// When empty, no CORS headers are sent.
+var corsOrigins []string
+
+// Whether unknown fields in the configuration file are an error
+var strictConfig bool
+
+// Time zone that times in responses and logs are given in
+var timeZone *time.Location = time.UTC
+
+// Whether responses carry absolute arrival timestamps alongside the
+// minutes
+var reportTimestamps bool
+
+// Arrival times at or below this many minutes are dropped as already
+// departed
+var expiredThreshold int
+
+// How long posted updates are held so that bursts can be applied
+// together, keeping only the latest times for each line; zero applies
+// each update as it arrives
+var coalesceWindow time.Duration
+
+// Arrival times at or below this many minutes are shown as "Due"
+var dueThreshold int
+
+// Arrival times beyond this many minutes are left out of responses,
+// though still kept; zero shows everything
+var window int
+
+// Whether stations may sit at (0, 0)
+var allowNullIsland bool
+
+// Cache-Control sent with successful reads of /info, /stop and /lines
+var cacheControl string
+
+// Whether a configuration without any stations is accepted
+var allowEmpty bool
+
+// Largest update body accepted, in bytes
+var maxBody int64
+
+// Whether station and line IDs match regardless of case; the
+// configured casing is still what gets reported
+var caseInsensitiveIDs bool
+
+// One slot per update being processed at once, across all systems;
+// nil for no limit
+var updateSlots chan struct{}
+
+// Prefix for every route, such as "/transit" when mounted there by a
+// reverse proxy; empty to serve from the root
+var basePath string
+
+// Time allowed to write a response; streams apply it to each event
+// instead. Zero means no limit.
+var writeTimeout time.Duration
+
+// How long without an update before /readyz reports the server as
+// not ready; zero disables the check
+var staleThreshold time.Duration
+
+// Downstream servers sent a copy of every accepted update
+var webhooks []*webhook
+
+// File recording every accepted update, one JSON line each; nil when
+// there isn't one. The lock keeps lines from interleaving.
+var auditLog *os.File
+var auditMu sync.Mutex
+
+// Webhook delivery limits
+const (
+	webhookTimeout    time.Duration = 5 * time.Second
+	webhookRetryDelay time.Duration = time.Second
+	webhookBuffer     int           = 64 // Updates queued per webhook before new ones are dropped
+)
+
+// Mean radius of the earth, used for great-circle distances
+const earthRadius float64 = 6371000 // meters
+
+// Number of stops returned by /nearest when none is requested
+const defaultNearest int = 3
+
+// How often streams send a comment to keep idle connections open
+const streamHeartbeat time.Duration = 15 * time.Second
+
+// Events buffered for a slow subscriber before new ones are dropped
+const streamBuffer int = 16
+
+// WebSocket limits
+const (
+	wsMaxMessage   int64         = 4096 // Clients only send subscribe requests
+	wsReadTimeout  time.Duration = 2 * streamHeartbeat
+	wsWriteTimeout time.Duration = 10 * time.Second
+)
+
+// Every route the server answers
+var mux = http.NewServeMux()
+
+// Limits how often each client may post updates; nil when unlimited
+var updateLimiter *rateLimiter
+
+// Recent updates by Idempotency-Key, so retries aren't applied twice;
+// nil when disabled
+var idempotencyKeys *idempotencyCache
+
+// Most Idempotency-Keys remembered at once
+const maxIdempotencyKeys = 1000
+
+// How often idle clients are dropped from the rate limiter
+const rateLimitSweep time.Duration = time.Minute
+
+// Most problems reported for a rejected update
+const maxUpdateErrors int = 50
+
+// Most stops returned by /search
+const maxSearchResults int = 10
+
+// Largest radius /lines/near will search, in meters
+const maxNearRadius float64 = 5000
+
+// Most stops one /stop/batch request may ask for
+const maxBatchStops int = 50
+
+// Strips accents from common Latin letters so that searches for
+// "cafe" find "Café"
+var accentFolder = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y",
+)
+
+// Settings from the command line that only matter while starting up;
+// the rest are kept in the package variables the handlers read
+type options struct {
+	configFiles       stringList
+	scaffold          string
+	validate          bool
+	gtfsStatic        string
+	basePath          string
+	addr              string
+	port              int
+	unixSocket        string
+	maxUpdates        int
+	updateRate        float64
+	updateBurst       int
+	idempotencyTTL    time.Duration
+	timeFormat        string
+	apiVersion        string
+	staleAfter        time.Duration
+	countdown         bool
+	countdownInterval time.Duration
+	readTimeout       time.Duration
+	idleTimeout       time.Duration
+	drain             time.Duration
+	tlsCert           string
+	tlsKey            string
+	cors              string
+	gtfsRtURL         string
+	gtfsRtInterval    time.Duration
+	gtfsRtMap         string
+	updateFile        string
+	updateInterval    time.Duration
+	feedURL           string
+	feedInterval      time.Duration
+	feedMap           string
+	auditLog          string
+	webhookURLs       stringList
+	tz                string
+	logLevel          string
+}
+
+// Define the command line flags on fs, which also puts every setting
+// they stand for back to its default
+func defineFlags(fs *flag.FlagSet) *options {
+	o := &options{}
+	fs.Var(&o.configFiles, "config", "Configuration file; repeat to serve several systems, each under /<file name>/")
+	fs.StringVar(&o.scaffold, "scaffold", "", "Write a starter configuration to this file ('-' for standard output) and exit")
+	fs.BoolVar(&o.validate, "validate", false, "Check the configuration and exit, reporting every problem found")
+	fs.StringVar(&o.gtfsStatic, "gtfsStatic", "", "GTFS static feed (zip or directory) to build the configuration from, instead of -config")
+	fs.StringVar(&o.basePath, "basePath", "", "Path prefix for every route, e.g. '/transit' behind a reverse proxy")
+	fs.StringVar(&o.addr, "addr", "", "Address to listen on (default all interfaces)")
+	fs.IntVar(&o.port, "port", 8080, "Port to listen on")
+	fs.StringVar(&o.unixSocket, "unixSocket", "", "Unix socket to listen on instead of TCP, e.g. behind nginx")
+	fs.StringVar(&updateKey, "updateKey", "", "API key required to post updates")
+	fs.StringVar(&debugKey, "debugKey", "", "API key required by /debug/config (default -updateKey)")
+	fs.BoolVar(&strictConfig, "strictConfig", false, "Reject configuration files containing unknown fields")
+	fs.BoolVar(&caseInsensitiveIDs, "caseInsensitiveIDs", false, "Match station and line IDs regardless of case")
+	fs.IntVar(&expiredThreshold, "expiredThreshold", 0, "Drop arrival times at or below this many minutes")
+	fs.IntVar(&dueThreshold, "dueThreshold", 0, "Show arrival times at or below this many minutes as 'Due'")
+	fs.IntVar(&window, "window", 0, "Leave arrival times beyond this many minutes out of responses (0 for no limit)")
+	fs.BoolVar(&allowNullIsland, "allowNullIsland", false, "Accept stations at coordinates (0, 0)")
+	fs.BoolVar(&allowEmpty, "allowEmpty", false, "Accept configurations without any stations")
+	fs.BoolVar(&hideOutOfService, "hideOutOfService", false, "Leave stations that are out of service out of responses")
+	fs.BoolVar(&ignoreOutOfService, "ignoreOutOfService", false, "Accept updates for stations that are out of service without applying them")
+	fs.Int64Var(&maxBody, "maxBody", 1<<20, "Largest update body accepted, in bytes")
+	fs.IntVar(&maxTimes, "maxTimes", 10, "Most arrival times accepted per line in an update (0 for no limit)")
+	fs.DurationVar(&staleThreshold, "staleThreshold", 0, "Report not ready when no update has arrived for this long (0 to disable)")
+	fs.StringVar(&staticDirectory, "staticDir", "static", "Directory holding update.html and badupdate.html")
+	fs.DurationVar(&coalesceWindow, "coalesce", 0, "Hold posted updates this long, e.g. '250ms', applying each line's latest times together (0 to disable)")
+	fs.IntVar(&o.maxUpdates, "maxConcurrentUpdates", 4, "Most updates processed at once; more get 503 (0 for no limit)")
+	fs.Float64Var(&o.updateRate, "updateRate", 0, "Updates per second allowed from each client IP (0 for no limit)")
+	fs.IntVar(&o.updateBurst, "updateBurst", 5, "Updates a client may send at once under -updateRate")
+	fs.DurationVar(&o.idempotencyTTL, "idempotencyTTL", 10*time.Minute, "How long an update's Idempotency-Key is remembered (0 to disable)")
+	fs.StringVar(&o.timeFormat, "timeFormat", "minutes", "Arrival times reported: 'minutes', or 'timestamps' to add Unix times")
+	fs.StringVar(&cacheControl, "cacheControl", "no-cache", "Cache-Control header for /info, /stop and /lines, e.g. 'max-age=5' behind a CDN")
+	fs.BoolVar(&gzipEnabled, "gzip", true, "Compress /info and /stop responses for clients that accept gzip")
+	fs.StringVar(&o.apiVersion, "apiVersion", "v2", "Default /info and /stop payload: 'v1' for only the original fields, or 'v2'")
+	fs.BoolVar(&allowJSONP, "allowJSONP", false, "Wrap /info and /stop in ?callback= for browsers without CORS")
+	fs.DurationVar(&o.staleAfter, "staleAfter", 0, "Log a warning when no update has arrived for this long (0 to disable)")
+	fs.BoolVar(&o.countdown, "countdown", false, "Count arrival times down between updates")
+	fs.DurationVar(&o.countdownInterval, "countdownInterval", time.Minute, "How often -countdown removes a minute")
+	fs.DurationVar(&o.readTimeout, "readTimeout", 10*time.Second, "Time allowed to read a request, including its body (0 for no limit)")
+	fs.DurationVar(&writeTimeout, "writeTimeout", 30*time.Second, "Time allowed to write a response, or each event on /stream (0 for no limit)")
+	fs.DurationVar(&o.idleTimeout, "idleTimeout", 2*time.Minute, "Time an idle keep-alive connection is kept open")
+	fs.DurationVar(&o.drain, "drainTimeout", 10*time.Second, "Time allowed for in-flight requests on shutdown")
+	fs.StringVar(&o.tlsCert, "tlsCert", "", "TLS certificate file; serves HTTPS along with -tlsKey")
+	fs.StringVar(&o.tlsKey, "tlsKey", "", "TLS private key file; serves HTTPS along with -tlsCert")
+	fs.StringVar(&o.cors, "corsOrigins", "", "Comma separated origins allowed cross-origin access, or '*'")
+	fs.StringVar(&o.gtfsRtURL, "gtfsRtURL", "", "GTFS-realtime TripUpdates feed to poll for arrival times")
+	fs.DurationVar(&o.gtfsRtInterval, "gtfsRtInterval", 30*time.Second, "How often to poll -gtfsRtURL")
+	fs.StringVar(&o.gtfsRtMap, "gtfsRtMap", "", "JSON file mapping GTFS stop and route IDs to station and line IDs")
+	fs.StringVar(&o.updateFile, "updateFile", "", "JSON update file to apply whenever it changes")
+	fs.DurationVar(&o.updateInterval, "updateInterval", 5*time.Second, "How often to check -updateFile")
+	fs.StringVar(&o.feedURL, "feedURL", "", "JSON feed to poll for arrival times")
+	fs.DurationVar(&o.feedInterval, "feedInterval", 30*time.Second, "How often to poll -feedURL")
+	fs.StringVar(&o.feedMap, "feedMap", "", "JSON file describing where -feedURL keeps stations, lines and times")
+	fs.StringVar(&o.auditLog, "auditLog", "", "File to append a JSON line to for every accepted update")
+	fs.Var(&o.webhookURLs, "webhook", "URL to forward accepted updates to; may be repeated")
+	fs.StringVar(&o.tz, "tz", "UTC", "Time zone for times in responses and logs, as an IANA name")
+	fs.StringVar(&o.logLevel, "logLevel", "info", "Minimum level logged (debug, info, warn, error)")
+	return o
+}
+
+// A flag that can't be applied, with what to log about it
+type flagError struct {
+	msg  string
+	args []any
+}
+
+func (e *flagError) Error() string {
+	return e.msg
+}
+
+// Set the package variables worked out from the flags, rather than set
+// by them directly, replacing whatever they held before
+func (o *options) apply() *flagError {
+	// Times are reported in the system's own time zone
+	loc, err := time.LoadLocation(o.tz)
+	if err != nil {
+		return &flagError{"Invalid time zone. Use '-tz=<IANA name, e.g. America/Los_Angeles>'", []any{"tz", o.tz}}
+	}
+	timeZone = loc
+
+	basePath = ""
+	if trimmed := strings.Trim(o.basePath, "/"); trimmed != "" {
+		basePath = "/" + trimmed
+		if path.Clean(basePath) != basePath || strings.ContainsAny(basePath, "?#") {
+			return &flagError{"Invalid base path. Use '-basePath=</path>'", []any{"basePath", o.basePath}}
+		}
+	}
+
+	updateLimiter = nil
+	if o.updateRate < 0 {
+		return &flagError{"Invalid update rate. Use '-updateRate=<updates per second>'", []any{"updateRate", o.updateRate}}
+	}
+	if o.updateRate > 0 {
+		if o.updateBurst < 1 {
+			return &flagError{"Invalid update burst. Use '-updateBurst=<1 or more>'", []any{"updateBurst", o.updateBurst}}
+		}
+		updateLimiter = newRateLimiter(o.updateRate, o.updateBurst)
+	}
+
+	idempotencyKeys = nil
+	if o.idempotencyTTL < 0 {
+		return &flagError{"Invalid idempotency TTL. Use '-idempotencyTTL=<duration>'", []any{"idempotencyTTL", o.idempotencyTTL}}
+	}
+	if o.idempotencyTTL > 0 {
+		idempotencyKeys = newIdempotencyCache(o.idempotencyTTL, maxIdempotencyKeys)
+	}
+
+	updateSlots = nil
+	if o.maxUpdates < 0 {
+		return &flagError{"Invalid concurrent update limit. Use '-maxConcurrentUpdates=<0 or more>'", []any{"maxConcurrentUpdates", o.maxUpdates}}
+	}
+	if o.maxUpdates > 0 {
+		updateSlots = make(chan struct{}, o.maxUpdates)
+	}
+
+	switch o.timeFormat {
+	case "minutes":
+		reportTimestamps = false
+	case "timestamps":
+		reportTimestamps = true
+	default:
+		return &flagError{"Invalid time format. Use '-timeFormat=<minutes|timestamps>'", []any{"timeFormat", o.timeFormat}}
+	}
+
+	switch o.apiVersion {
+	case "v1":
+		apiVersion = 1
+	case "v2":
+		apiVersion = 2
+	default:
+		return &flagError{"Invalid API version. Use '-apiVersion=<v1|v2>'", []any{"apiVersion", o.apiVersion}}
+	}
+
+	webhooks = nil
+	for _, u := range o.webhookURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return &flagError{"Invalid webhook. Use '-webhook=<http(s) URL>'", []any{"webhook", u}}
+		}
+		webhooks = append(webhooks, newWebhook(u))
+	}
+
+	auditLog = nil
+	if o.auditLog != "" {
+		if auditLog, err = os.OpenFile(o.auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640); err != nil {
+			return &flagError{"Unable to open audit log. Use '-auditLog=<file>'", []any{"auditLog", o.auditLog, "error", err}}
+		}
+	}
+
+	corsOrigins = nil
+	for _, origin := range strings.Split(o.cors, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	return nil
+}
+
+// Main runs the server as the command line flags describe, along with
+// the build information to report
+func Main(buildVersion, buildCommit, builtOn string) {
+	version, commit, buildDate = buildVersion, buildCommit, builtOn
+
+	// Setup command line flags
+	o := defineFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Log JSON lines at the requested level
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.logLevel)); err != nil {
+		fatal("Invalid log level. Use '-logLevel=<debug|info|warn|error>'", "logLevel", o.logLevel)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.TimeValue(a.Value.Time().In(timeZone))
+			}
+			return a
+		},
+	})}))
+
+	// Settle the settings worked out from the flags
+	if err := o.apply(); err != nil {
+		fatal(err.msg, err.args...)
+	}
+
+	// Give new users something to edit
+	if o.scaffold != "" {
+		if err := scaffold(o.scaffold); err != nil {
+			fatal("Unable to write starter configuration", "file", o.scaffold, "error", err)
+		}
+		if o.scaffold != "-" {
+			fmt.Printf("Wrote %s; edit it, then run with -config=%s\n", o.scaffold, o.scaffold)
+		}
+		os.Exit(0)
+	}
+
+	// Just check the configuration, without serving it
+	if o.validate {
+		if len(o.configFiles) == 0 && o.gtfsStatic == "" {
+			fatal("Nothing to validate. Use '-config=<config filename>' or '-gtfsStatic=<GTFS feed>'")
+		}
+		os.Exit(validateConfigs(o.configFiles, o.gtfsStatic))
+	}
+
+	slog.Info("Starting server", "version", version, "commit", commit)
+	if len(o.configFiles) == 0 && o.gtfsStatic == "" {
+		fatal("No configuration provided. Use '-config=<config filename>' or '-gtfsStatic=<GTFS feed>'")
+	}
+	if len(o.configFiles) > 0 && o.gtfsStatic != "" {
+		fatal("Use only one of '-config' and '-gtfsStatic'")
+	}
+	if o.port < 1 || o.port > 65535 {
+		fatal("Invalid port. Use '-port=<1-65535>'", "port", o.port)
+	}
+	if o.unixSocket != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "port" || f.Name == "addr" {
+				fatal("Use only one of '-unixSocket' and '-port' or '-addr'")
+			}
+		})
+	}
+	if (o.tlsCert == "") != (o.tlsKey == "") {
+		fatal("TLS needs both a certificate and a key. Use '-tlsCert=<file> -tlsKey=<file>'")
+	}
+	if info, err := os.Stat(staticDirectory); err != nil || !info.IsDir() {
+		fatal("Static directory not found. Use '-staticDir=<directory>'", "staticDir", staticDirectory)
+	}
+	for _, f := range []string{"update.html", "badupdate.html"} {
+		if _, err := os.Stat(filepath.Join(staticDirectory, f)); err != nil {
+			fatal("Static directory is missing a page. Use '-staticDir=<directory>'", "staticDir", staticDirectory, "file", f)
+		}
+	}
+	if window < 0 {
+		fatal("Invalid display window. Use '-window=<minutes>'", "window", window)
+	}
+	if coalesceWindow < 0 {
+		fatal("Invalid coalescing window. Use '-coalesce=<duration>'", "coalesce", coalesceWindow)
+	}
+	if o.staleAfter < 0 {
+		fatal("Invalid stale threshold. Use '-staleAfter=<duration>'", "staleAfter", o.staleAfter)
+	}
+	if o.countdown && o.countdownInterval <= 0 {
+		fatal("Invalid countdown interval. Use '-countdownInterval=<duration>'", "countdownInterval", o.countdownInterval)
+	}
+
+	var gtfsRtMap *gtfsMapping
+	if o.gtfsRtURL != "" {
+		if o.gtfsRtMap == "" {
+			fatal("GTFS-realtime needs an ID mapping. Use '-gtfsRtMap=<mapping filename>'")
+		}
+		if o.gtfsRtInterval <= 0 {
+			fatal("Invalid GTFS-realtime interval. Use '-gtfsRtInterval=<duration>'", "gtfsRtInterval", o.gtfsRtInterval)
+		}
+
+		var err error
+		if gtfsRtMap, err = readGTFSMapping(o.gtfsRtMap); err != nil {
+			fatal("Unable to load GTFS mapping", "error", err)
+		}
+	}
+
+	if o.updateFile != "" && o.updateInterval <= 0 {
+		fatal("Invalid update file interval. Use '-updateInterval=<duration>'", "updateInterval", o.updateInterval)
+	}
+
+	var feedMap *feedMapping
+	if o.feedURL != "" {
+		if o.feedMap == "" {
+			fatal("Polling a feed needs a mapping. Use '-feedMap=<mapping filename>'")
+		}
+		if o.feedInterval <= 0 {
+			fatal("Invalid feed interval. Use '-feedInterval=<duration>'", "feedInterval", o.feedInterval)
+		}
+
+		var err error
+		if feedMap, err = readFeedMapping(o.feedMap); err != nil {
+			fatal("Unable to load feed mapping", "error", err)
+		}
+	}
+
+	// Build the server configuration, either from our own format or
+	// from a GTFS feed. Several configuration files each get their own
+	// system, named after the file; the first is the main system.
+	if o.gtfsStatic != "" {
+		systems = append(systems, &hostedSystem{
+			source: o.gtfsStatic,
+			load:   func() (*system, error) { return loadGTFS(o.gtfsStatic) },
+			sys:    &mainSystem,
+		})
+	}
+	names := make(map[string]bool)
+	for i, filename := range o.configFiles {
+		filename := filename
+		h := &hostedSystem{
+			source: filename,
+			load:   func() (*system, error) { return loadConfig(filename) },
+			sys:    &mainSystem,
+		}
+		if len(o.configFiles) > 1 {
+			h.name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+			if h.name == "" || names[h.name] || url.PathEscape(h.name) != h.name {
+				fatal("Configuration files need distinct, URL safe names to serve several systems", "config", filename)
+			}
+			names[h.name] = true
+		}
+		if i > 0 {
+			h.sys = &system{}
+		}
+		systems = append(systems, h)
+	}
+	for _, h := range systems {
+		readConfig(h)
+	}
+
+	setupRoutes()
+
+	// Reload the configuration when asked, keeping the old one if
+	// the new one can't be read
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			for _, h := range systems {
+				fresh, err := h.load()
+				if err != nil {
+					slog.Error("Unable to reload configuration", "config", h.source, "error", err)
+					continue
+				}
+
+				h.sys.replace(fresh)
+				slog.Info("Reloaded configuration", "config", h.source)
+			}
+		}
+	}()
+
+	// Drain outstanding requests when asked to stop
+	listenAddr := net.JoinHostPort(o.addr, strconv.Itoa(o.port))
+	server := &http.Server{
+		Addr:         listenAddr,
+		ReadTimeout:  o.readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  o.idleTimeout,
+		Handler:      mux,
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+	}
+
+	// Streams never finish on their own, so end them when draining
+	base, endStreams := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return base }
+	server.RegisterOnShutdown(endStreams)
+
+	// Keep displays plausible when feeders are slow
+	if o.countdown {
+		go func() {
+			ticker := time.NewTicker(o.countdownInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-base.Done():
+					return
+				case <-ticker.C:
+					for _, h := range systems {
+						h.sys.countdown()
+					}
+				}
+			}
+		}()
+	}
+
+	// Take arrival times from the agency's own feed
+	if gtfsRtMap != nil {
+		go pollGTFSRealtime(base, o.gtfsRtURL, o.gtfsRtInterval, gtfsRtMap)
+	}
+	if o.updateFile != "" {
+		go pollUpdateFile(base, o.updateFile, o.updateInterval)
+	}
+	if feedMap != nil {
+		go pollFeed(base, o.feedURL, o.feedInterval, feedMap)
+	}
+
+	if updateLimiter != nil {
+		go updateLimiter.sweep(base)
+	}
+
+	// Apply bursts of updates together
+	if coalesceWindow > 0 {
+		for _, h := range systems {
+			go h.sys.coalesce(base, coalesceWindow)
+		}
+	}
+
+	// Keep an eye on the feeders
+	if o.staleAfter > 0 {
+		for _, h := range systems {
+			go h.sys.watchStale(base, h.name, o.staleAfter)
+		}
+	}
+
+	// Pass accepted updates on to other servers
+	for _, h := range webhooks {
+		go h.run(base)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		slog.Info("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), o.drain)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Unable to drain connections", "error", err)
+		}
+		close(stopped)
+	}()
+
+	// Run server on the requested port, or socket
+	var listener net.Listener
+	var err error
+	if o.unixSocket != "" {
+		listenAddr = o.unixSocket
+		listener, err = listenUnix(o.unixSocket)
+	} else {
+		listener, err = net.Listen("tcp", listenAddr)
+	}
+	if err != nil {
+		fatal("Unable to listen", "addr", listenAddr, "error", err)
+	}
+	if o.tlsCert != "" {
+		slog.Info("Listening", "addr", listenAddr, "tls", true)
+		err = server.ServeTLS(listener, o.tlsCert, o.tlsKey)
+	} else {
+		slog.Info("Listening", "addr", listenAddr)
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		fatal("Unable to serve", "error", err)
+	}
+
+	<-stopped
+	slog.Info("Server stopped")
+}
+
+// Listen on a Unix socket, replacing one left behind by an earlier run.
+// Only the owner and group may connect, so the proxy's user needs to be
+// in the server's group. The socket is removed again when the server
+// shuts down.
+func listenUnix(name string) (net.Listener, error) {
+	if info, err := os.Lstat(name); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", name)
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(name, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// JSON encode all of the information
+func (s *system) handleInfo(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+	s.tick()
+
+	dir, ok := requestedDirection(w, r)
+	if !ok {
+		return
+	}
+	order := r.URL.Query().Get("sort")
+	if order != "" && order != "name" && order != "id" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid sort (%s)", order))
+		return
+	}
+
+	// Read before encoding, so that it can only understate the body
+	modified := s.lastModified()
+
+	// The headers don't depend on the body, so monitoring tools'
+	// HEAD requests needn't encode it
+	if r.Method == "HEAD" {
+		if !infoHeaders(w, r, s.version.Load(), modified) {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+
+	// Only the unfiltered, default ordered JSON body is worth caching
+	var body []byte
+	var version uint64
+	var err error
+	msgpack := wantsMsgpack(r)
+	v1 := wantsV1(r)
+	if dir < 0 && order == "" && !msgpack && !v1 {
+		body, version, err = s.infoJSON()
+	} else {
+		version = s.version.Load()
+		snap := s.snapshot()
+		if dir >= 0 {
+			for i := 0; i < len(snap.Stops); i++ {
+				snap.Stops[i].keepDirection(dir)
+			}
+		}
+		switch order {
+		case "name":
+			slices.SortStableFunc(snap.Stops, func(a, b *stationSnapshot) int { return strings.Compare(a.Name, b.Name) })
+		case "id":
+			slices.SortStableFunc(snap.Stops, func(a, b *stationSnapshot) int { return strings.Compare(a.ID, b.ID) })
+		}
+		var payload any = snap
+		if v1 {
+			payload = snap.v1()
+		}
+		if msgpack {
+			body, err = encodeMsgpack(payload)
+		} else {
+			body, err = encodeJSON(payload)
+		}
+	}
+	if err == nil && wantsPretty(r) && !msgpack {
+		var buf bytes.Buffer
+		err = json.Indent(&buf, body, "", "  ")
+		body = buf.Bytes()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+		return
+	}
+
+	if infoHeaders(w, r, version, modified) {
+		return
+	}
+	w.Write(body)
+}
+
+// Set the headers for an /info response, answering 304 instead if the
+// client already has this version. Indented and msgpack bodies are
+// different representations, so get their own tags.
+func infoHeaders(w http.ResponseWriter, r *http.Request, version uint64, modified time.Time) (notModified bool) {
+	tag := etag(version)
+	if wantsV1(r) {
+		tag = strings.TrimSuffix(tag, `"`) + `-v1"`
+	}
+	contentType := "application/json"
+	if wantsMsgpack(r) {
+		tag = strings.TrimSuffix(tag, `"`) + `-msgpack"`
+		contentType = "application/msgpack"
+	} else if wantsPretty(r) {
+		tag = strings.TrimSuffix(tag, `"`) + `-pretty"`
+	}
+	w.Header().Set("ETag", tag)
+	w.Header().Add("Vary", "Accept")
+	if fresh := notModifiedSince(w, r, modified); etagMatches(r, tag) || fresh {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	return false
+}
+
+func (s *system) handleStopInfo(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	stop := s.findStop(w, r)
+	if stop == nil {
+		return
+	}
+	dir, ok := requestedDirection(w, r)
+	if !ok {
+		return
+	}
+
+	s.tick()
+	if notModifiedSince(w, r, s.lastModified()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	snap := stop.snapshot()
+	if dir >= 0 {
+		snap.keepDirection(dir)
+	}
+	var payload any = snap
+	if wantsV1(r) {
+		payload = snap.v1()
+	}
+
+	// Send the response, as msgpack for clients that ask
+	w.Header().Add("Vary", "Accept")
+	if wantsMsgpack(r) {
+		body, err := encodeMsgpack(payload)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Internal Server Error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(payload); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Several stops at once, keyed by station ID, for boards showing more
+// than one
+type stopBatch struct {
+	Stops   map[string]*stationSnapshot `json:"stops"`
+	Unknown []string                    `json:"unknown"` // Requested IDs with no station
+}
+
+// Send several stops in one response. IDs come from ?ids=a,b,c or,
+// for long lists, a POSTed {"ids": [...]}.
+func (s *system) handleStopBatch(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if r.Method == "POST" {
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Expected {\"ids\": [...]}")
+			return
+		}
+		ids = req.IDs
+	} else if param := r.URL.Query().Get("ids"); param != "" {
+		ids = strings.Split(param, ",")
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, "Missing stop IDs")
+		return
+	}
+	if len(ids) > maxBatchStops {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Too many stop IDs (%d, max %d)", len(ids), maxBatchStops))
+		return
+	}
+
+	// One read lock covers the whole batch, so the stops are consistent
+	// with one another
+	s.RLock()
+	defer s.RUnlock()
+
+	batch := stopBatch{Stops: make(map[string]*stationSnapshot), Unknown: []string{}}
+	for _, id := range ids {
+		stop := s.stopMap[idKey(id)]
+		if stop == nil || stop.hidden() {
+			batch.Unknown = append(batch.Unknown, id)
+			continue
+		}
+		if batch.Stops[stop.ID] == nil {
+			batch.Stops[stop.ID] = stop.snapshot()
+		}
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(batch); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// A direction of a station, by its line index
+type stopDirection struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+}
+
+// List a station's direction names in line index order, for boards
+// laid out by direction
+func (s *system) handleStopDirections(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	stop := s.findStop(w, r)
+	if stop == nil {
+		return
+	}
+
+	directions := make([]stopDirection, len(stop.Directions))
+	for i, name := range stop.Directions {
+		directions[i] = stopDirection{i, name}
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(directions); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// A line along with its upcoming arrivals, soonest first
+type lineArrivals struct {
+	*lineSnapshot
+	Next     *int  `json:"next"`
+	Arrivals []int `json:"arrivals"`
+}
+
+// A station whose lines include their upcoming arrivals
+type stationArrivals struct {
+	*stationSnapshot
+	Lines [2]map[string]*lineArrivals `json:"lines"`
+}
+
+// Like /stop, but with the next arrival worked out for each line
+func (s *system) handleStopNext(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	stop := s.findStop(w, r)
+	if stop == nil {
+		return
+	}
+
+	snap := stop.snapshot()
+	next := stationArrivals{stationSnapshot: snap}
+	for dir, lines := range snap.Lines {
+		if lines == nil {
+			continue
+		}
+
+		next.Lines[dir] = make(map[string]*lineArrivals, len(lines))
+		for id, ln := range lines {
+			arrivals := make([]int, 0, len(ln.Times))
+			for _, t := range ln.Times {
+				if t >= 0 {
+					arrivals = append(arrivals, t)
+				}
+			}
+			sort.Ints(arrivals)
+
+			la := &lineArrivals{lineSnapshot: ln, Arrivals: arrivals}
+			if len(arrivals) > 0 {
+				la.Next = &arrivals[0]
+			}
+			next.Lines[dir][id] = la
+		}
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(next); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Read the optional dir parameter, answering the request with a 400
+// if it isn't a valid direction index. Returns -1 if it wasn't given.
+func requestedDirection(w http.ResponseWriter, r *http.Request) (int, bool) {
+	param := r.URL.Query().Get("dir")
+	if param == "" {
+		return -1, true
+	}
+
+	dir, err := strconv.Atoi(param)
+	if err != nil || dir < 0 || dir >= len(station{}.Lines) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid direction (%s)", param))
+		return 0, false
+	}
+
+	return dir, true
+}
+
+// The form of a station ID used as a stopMap key
+func idKey(id string) string {
+	if caseInsensitiveIDs {
+		return strings.ToLower(id)
+	}
+	return id
+}
+
+// Look up a line in one direction of a station, by ID
+func findLine(lines map[string]*line, id string) *line {
+	if ln := lines[id]; ln != nil || !caseInsensitiveIDs {
+		return ln
+	}
+	for key, ln := range lines {
+		if strings.EqualFold(key, id) {
+			return ln
+		}
+	}
+	return nil
+}
+
+// Look up a line in one direction of a station by name, for feeders
+// that don't know the IDs. Names are compared as in search. The line
+// is only returned if exactly one matches; the count says how many did.
+func findLineByName(lines map[string]*line, name string) (*line, int) {
+	var found *line
+	matches := 0
+	for _, ln := range lines {
+		if foldName(ln.Name) == foldName(name) {
+			found = ln
+			matches++
+		}
+	}
+	if matches != 1 {
+		return nil, matches
+	}
+	return found, matches
+}
+
+// Look up the stop named by the id parameter, answering the request
+// with a 400 if there isn't one. The caller must hold the system lock.
+func (s *system) findStop(w http.ResponseWriter, r *http.Request) *station {
+	// Check for valid GET parameters
+	stopID := r.URL.Query()["id"]
+	if stopID == nil || len(stopID) != 1 {
+		writeError(w, http.StatusBadRequest, "Missing stop ID")
+		return nil
+	}
+
+	// Try to find the correct stop
+	stop := s.stopMap[idKey(stopID[0])]
+	if stop == nil || stop.hidden() {
+		slog.DebugContext(r.Context(), "Unknown stop requested", "handler", "stop", "stopID", stopID[0], "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid stop id (%s)", stopID[0]))
+		return nil
+	}
+
+	return stop
+}
+
+// A station annotated with its distance from a requested point
+type nearbyStation struct {
+	*stationSnapshot
+	DistanceMeters float64 `json:"distanceMeters"`
+
+	stop *station
+}
+
+// Find the stops closest to a given coordinate
+func (s *system) handleNearest(w http.ResponseWriter, r *http.Request) {
+	// Check for valid GET parameters
+	query := r.URL.Query()
+	lat, laterr := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, lonerr := strconv.ParseFloat(query.Get("lon"), 64)
+	if laterr != nil || lonerr != nil || !(coordinates{lat, lon}).valid() {
+		writeError(w, http.StatusBadRequest, "Missing or invalid coordinates (lat, lon)")
+		return
+	}
+
+	n := defaultNearest
+	if query.Get("n") != "" {
+		var err error
+		if n, err = strconv.Atoi(query.Get("n")); err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid stop count (%s)", query.Get("n")))
+			return
+		}
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	point := coordinates{Lat: lat, Lon: lon}
+	nearby := make([]nearbyStation, 0, len(s.Stops))
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		nearby = append(nearby, nearbyStation{DistanceMeters: haversine(point, stop.Coord), stop: stop})
+	}
+
+	sort.Slice(nearby, func(i, j int) bool {
+		return nearby[i].DistanceMeters < nearby[j].DistanceMeters
+	})
+	if n > len(nearby) {
+		n = len(nearby)
+	}
+	for i := 0; i < n; i++ {
+		nearby[i].stationSnapshot = nearby[i].stop.snapshot()
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(nearby[:n]); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Index entry for a station, without any line information
+type stationSummary struct {
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	Coord        coordinates `json:"coord"`
+	OutOfService bool        `json:"outOfService,omitempty"`
+}
+
+// List every station, for pickers and maps
+func (s *system) handleStops(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	stops := make([]stationSummary, 0, len(s.Stops))
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		stops = append(stops, stationSummary{stop.ID, stop.Name, stop.Coord, stop.OutOfService})
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(stops); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// List the stations inside a rectangle, for map views. A box whose
+// minLon is greater than its maxLon crosses the antimeridian.
+func (s *system) handleStopsBBox(w http.ResponseWriter, r *http.Request) {
+	// Check for valid GET parameters
+	query := r.URL.Query()
+	var bounds [4]float64
+	for i, name := range []string{"minLat", "minLon", "maxLat", "maxLon"} {
+		var err error
+		if bounds[i], err = strconv.ParseFloat(query.Get(name), 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Missing or invalid bounds (minLat, minLon, maxLat, maxLon)")
+			return
+		}
+	}
+	minLat, minLon, maxLat, maxLon := bounds[0], bounds[1], bounds[2], bounds[3]
+	if !(coordinates{minLat, minLon}).valid() || !(coordinates{maxLat, maxLon}).valid() {
+		writeError(w, http.StatusBadRequest, "Bounds out of range")
+		return
+	}
+	if minLat > maxLat {
+		writeError(w, http.StatusBadRequest, "minLat is greater than maxLat")
+		return
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	stops := []stationSummary{}
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		lat, lon := stop.Coord.Lat, stop.Coord.Lon
+		if lat < minLat || lat > maxLat {
+			continue
+		}
+		if minLon <= maxLon && (lon < minLon || lon > maxLon) {
+			continue
+		}
+		if minLon > maxLon && lon < minLon && lon > maxLon {
+			continue
+		}
+		stops = append(stops, stationSummary{stop.ID, stop.Name, stop.Coord, stop.OutOfService})
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(stops); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Search result for a station
+type searchResult struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	prefix   bool // Name starts with the query
+	substr   bool // Name contains the query
+	distance int  // Edit distance between the name and the query
+}
+
+// Find stations by (partial) name, best matches first
+func (s *system) handleSearch(w http.ResponseWriter, r *http.Request) {
+	// Check for valid GET parameters
+	q := foldName(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		writeError(w, http.StatusBadRequest, "Missing search query")
+		return
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	// Anything containing the query matches; so does anything with a
+	// word that is a small typo away from it
+	tolerance := len([]rune(q)) / 4
+	results := []searchResult{}
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		name := foldName(stop.Name)
+		result := searchResult{
+			ID:       stop.ID,
+			Name:     stop.Name,
+			prefix:   strings.HasPrefix(name, q),
+			substr:   strings.Contains(name, q),
+			distance: levenshtein(q, name),
+		}
+
+		if !result.substr {
+			typo := false
+			for _, word := range strings.Fields(name) {
+				if levenshtein(q, word) <= tolerance {
+					typo = true
+					break
+				}
+			}
+			if !typo {
+				continue
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.prefix != b.prefix {
+			return a.prefix
+		}
+		if a.substr != b.substr {
+			return a.substr
+		}
+		return a.distance < b.distance
+	})
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(results); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Catalog entry for a line, independent of any station
+type lineSummary struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// List every line in the system, once each
+func (s *system) handleLines(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	// The same line usually serves several stations; the first
+	// one seen wins
+	seen := make(map[string]bool)
+	lines := []lineSummary{}
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				if seen[idKey(ln.ID)] {
+					continue
+				}
+				seen[idKey(ln.ID)] = true
+				lines = append(lines, lineSummary{ln.ID, ln.Name, ln.Color})
+			}
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Name != lines[j].Name {
+			return lines[i].Name < lines[j].Name
+		}
+		return lines[i].ID < lines[j].ID
+	})
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(lines); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Decode an update, insisting on the exact field names: encoding/json
+// matches them case-insensitively, so "lineId" would otherwise quietly
+// fill LineID while "Lines" filled Lines
+func decodeUpdate(body []byte, u *update) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(u); err != nil {
+		return err
+	}
+	return exactFields(body, reflect.TypeOf(u).Elem(), "update")
+}
+
+// Check every object key in data against the json tags of t, naming the
+// first one that is only a case-insensitive match
+func exactFields(data []byte, t reflect.Type, where string) error {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return exactFields(data, t.Elem(), where)
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return nil // null, or already rejected by the decoder
+		}
+		for i, item := range items {
+			if err := exactFields(item, t.Elem(), fmt.Sprintf("%s[%d]", where, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(data, &fields) != nil {
+			return nil
+		}
+		keys := slices.Sorted(maps.Keys(fields))
+		for _, key := range keys {
+			f, ok := fieldTagged(t, key)
+			if !ok {
+				for i := 0; i < t.NumField(); i++ {
+					if tag := jsonName(t.Field(i)); strings.EqualFold(tag, key) {
+						return fmt.Errorf("json: unknown field %q in %s; did you mean %q?", key, where, tag)
+					}
+				}
+				return fmt.Errorf("json: unknown field %q in %s", key, where)
+			}
+			if err := exactFields(fields[key], f.Type, where+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The field of t whose json tag is exactly name
+func fieldTagged(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() && jsonName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// The name a field is encoded under
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// A line serving stations near a point, for /lines/near
+type nearbyLine struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Color      string   `json:"color"`
+	Soonest    *int     `json:"soonest"` // Minutes until the first arrival at any of the stations; null if none
+	StationIDs []string `json:"stationIDs"`
+}
+
+// List the lines serving every station within a radius of a point,
+// each with its soonest arrival among them
+func (s *system) handleLinesNear(w http.ResponseWriter, r *http.Request) {
+	// Check for valid GET parameters
+	query := r.URL.Query()
+	lat, laterr := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, lonerr := strconv.ParseFloat(query.Get("lon"), 64)
+	if laterr != nil || lonerr != nil || !(coordinates{lat, lon}).valid() {
+		writeError(w, http.StatusBadRequest, "Missing or invalid coordinates (lat, lon)")
+		return
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+	if err != nil || !(radius > 0 && radius <= maxNearRadius) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid radius (%s); use more than 0, up to %g meters", query.Get("radius"), maxNearRadius))
+		return
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	point := coordinates{Lat: lat, Lon: lon}
+	found := make(map[string]*nearbyLine)
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() || haversine(point, stop.Coord) > radius {
+			continue
+		}
+
+		stop.RLock()
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				near := found[ln.ID]
+				if near == nil {
+					near = &nearbyLine{ID: ln.ID, Name: ln.Name, Color: ln.Color, StationIDs: []string{}}
+					found[ln.ID] = near
+				}
+				if !slices.Contains(near.StationIDs, stop.ID) {
+					near.StationIDs = append(near.StationIDs, stop.ID)
+				}
+				// Times are kept sorted, so the first is the soonest
+				current, _ := ln.current(now)
+				if times := inWindow(current); len(times) > 0 && (near.Soonest == nil || times[0] < *near.Soonest) {
+					soonest := times[0]
+					near.Soonest = &soonest
+				}
+			}
+		}
+		stop.RUnlock()
+	}
+
+	// Soonest first; lines with nothing coming go last
+	lines := make([]*nearbyLine, 0, len(found))
+	for _, near := range found {
+		lines = append(lines, near)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if (a.Soonest == nil) != (b.Soonest == nil) {
+			return b.Soonest == nil
+		}
+		if a.Soonest != nil && *a.Soonest != *b.Soonest {
+			return *a.Soonest < *b.Soonest
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(lines); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Totals for a system, for /stats
+type systemStats struct {
+	Stations     int     `json:"stations"`
+	Lines        int     `json:"lines"`        // Distinct line IDs
+	Reporting    int     `json:"reporting"`    // Lines at a station, per direction, with any arrival times
+	AverageTimes float64 `json:"averageTimes"` // Arrival times per line at a station, per direction
+}
+
+// Count the stations and lines in the system, and how many of them
+// have arrivals
+func (s *system) handleStats(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	s.RLock()
+	now := time.Now()
+	var stats systemStats
+	ids := make(map[string]bool)
+	served, times := 0, 0
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		stats.Stations++
+		stop.RLock()
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				ids[idKey(ln.ID)] = true
+				served++
+				current, _ := ln.current(now)
+				times += len(current)
+				if len(current) > 0 {
+					stats.Reporting++
+				}
+			}
+		}
+		stop.RUnlock()
+	}
+	s.RUnlock()
+
+	stats.Lines = len(ids)
+	if served > 0 {
+		stats.AverageTimes = float64(times) / float64(served)
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(stats); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// A station served by a line, for /line
+type lineStop struct {
+	StationID string `json:"stationID"`
+	Index     int    `json:"index"`
+	Times     []int  `json:"times"`
+}
+
+// A line and every station it serves
+type lineInfo struct {
+	ID    string     `json:"id"`
+	Name  string     `json:"name"`
+	Color string     `json:"color"`
+	Stops []lineStop `json:"stops"`
+}
+
+// Show where a line stops and its times at each station
+func (s *system) handleLineInfo(w http.ResponseWriter, r *http.Request) {
+	// Check for valid GET parameters
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "Missing line ID")
+		return
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	var info *lineInfo
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop.hidden() {
+			continue
+		}
+		stop.RLock()
+		for dir, lines := range stop.Lines {
+			ln := findLine(lines, id)
+			if ln == nil {
+				continue
+			}
+
+			// The first station seen names the line
+			if info == nil {
+				info = &lineInfo{ID: ln.ID, Name: ln.Name, Color: ln.Color, Stops: []lineStop{}}
+			}
+			current, _ := ln.current(now)
+			info.Stops = append(info.Stops, lineStop{stop.ID, dir, inWindow(current)})
+		}
+		stop.RUnlock()
+	}
+
+	if info == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid line ID (%s)", id))
+		return
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(info); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Request to recolor a line
+type lineColor struct {
+	LineID string `json:"lineID"`
+	Index  *int   `json:"index"` // Both directions if unset
+	Color  string `json:"color"`
+}
+
+// Change a line's color everywhere it stops, for when a line is
+// rebranded
+func (s *system) handleLineColor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PATCH" {
+		w.Header().Set("Allow", "POST, PATCH")
+		writeError(w, http.StatusMethodNotAllowed, "Use POST or PATCH")
+		return
+	}
+
+	// Recoloring takes the same key as updates
+	if !authorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized update", "handler", "lineColor", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	var req lineColor
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || req.LineID == "" {
+		writeError(w, http.StatusBadRequest, "Expected {\"lineID\", \"index\", \"color\"}")
+		return
+	}
+	if !isValidColor(req.Color) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid color (%s)", req.Color))
+		return
+	}
+
+	// Colors are part of the system's structure, so this needs the
+	// writer lock
+	s.Lock()
+	defer s.Unlock()
+
+	if req.Index != nil {
+		directions := 0
+		for _, stop := range s.Stops {
+			directions = max(directions, len(stop.Lines))
+		}
+		if *req.Index < 0 || *req.Index >= directions {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid index (%d); stations have at most %d directions", *req.Index, directions))
+			return
+		}
+	}
+
+	touched := make(map[*station]bool)
+	recolored := make(map[*line]bool)
+	summary := updateSummary{}
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		for dir, lines := range stop.Lines {
+			if req.Index != nil && *req.Index != dir {
+				continue
+			}
+			if ln := findLine(lines, req.LineID); ln != nil {
+				ln.Color = req.Color
+				touched[stop] = true
+				recolored[ln] = true
+				summary.LinesUpdated++
+			}
+		}
+	}
+	if len(touched) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid line ID (%s)", req.LineID))
+		return
+	}
+	summary.StationsUpdated = len(touched)
+
+	s.changed()
+	s.notify(touched, recolored)
+	slog.InfoContext(r.Context(), "Recolored line", "handler", "lineColor", "remoteAddr", r.RemoteAddr, "lineID", req.LineID, "color", req.Color)
+
+	// Report what was touched
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(summary); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Request to set or clear an alert
+type alert struct {
+	StationID string `json:"stationID"` // The whole system's alert if empty
+	Alert     string `json:"alert"`     // Cleared if empty
+}
+
+// Set or clear the alert for a station or the whole system, such as
+// "Elevator out at Civic Center"
+func (s *system) handleAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "Use POST")
+		return
+	}
+
+	// Alerts take the same key as updates
+	if !authorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized update", "handler", "alert", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	var req alert
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected {\"stationID\", \"alert\"}")
+		return
+	}
+
+	// Alerts sit alongside names, under the writer lock
+	s.Lock()
+	defer s.Unlock()
+
+	// The system's alert is only in snapshots, so subscribers to the
+	// whole system get a fresh one
+	var touched map[*station]bool
+	if req.StationID == "" {
+		s.Alert = req.Alert
+	} else {
+		stop := s.stopMap[idKey(req.StationID)]
+		if stop == nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid station ID (%s)", req.StationID))
+			return
+		}
+		stop.Alert = req.Alert
+		touched = map[*station]bool{stop: true}
+	}
+
+	s.changed()
+	s.notify(touched, nil)
+	slog.InfoContext(r.Context(), "Set alert", "handler", "alert", "remoteAddr", r.RemoteAddr, "stopID", req.StationID, "alert", req.Alert)
+
+	// Echo what is now shown
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(req); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Whether a station is in service, for POST /station/service
+type serviceChange struct {
+	StationID    string `json:"stationID"`
+	OutOfService bool   `json:"outOfService"`
+}
+
+// Take a station out of service, or put it back, until the
+// configuration is reloaded
+func (s *system) handleStationService(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "Use POST")
+		return
+	}
+
+	// Takes the same key as updates
+	if !authorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized update", "handler", "stationService", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	var req serviceChange
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected {\"stationID\", \"outOfService\"}")
+		return
+	}
+
+	// Obtain a writer lock, since hiding a station changes the
+	// structure readers see
+	s.Lock()
+	defer s.Unlock()
+
+	stop := s.stopMap[idKey(req.StationID)]
+	if stop == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid station ID (%s)", req.StationID))
+		return
+	}
+	req.StationID = stop.ID
+	if stop.OutOfService != req.OutOfService {
+		stop.OutOfService = req.OutOfService
+		s.changed()
+
+		// A station appearing or disappearing needs fresh snapshots
+		if hideOutOfService {
+			s.notify(nil, nil)
+		} else {
+			s.notify(map[*station]bool{stop: true}, nil)
+		}
+	}
+	slog.InfoContext(r.Context(), "Set station service", "handler", "stationService", "remoteAddr", r.RemoteAddr, "stopID", stop.ID, "outOfService", req.OutOfService)
+
+	// Echo what is now shown
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(req); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Add or remove a station while running, such as a temporary stop for
+// an event. Either lasts until the configuration is reloaded.
+func (s *system) handleStation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "Use POST or DELETE")
+		return
+	}
+
+	// Takes the same key as updates
+	if !authorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized update", "handler", "station", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		s.removeStation(w, r)
+	} else {
+		s.addStation(w, r)
+	}
+}
+
+// Add the posted station
+func (s *system) addStation(w http.ResponseWriter, r *http.Request) {
+	stop := &station{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(stop); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder(w, r).Encode(apiError{Error: "malformed json", Detail: err.Error()})
+		return
+	}
+
+	if stop.ID == "" {
+		writeError(w, http.StatusBadRequest, "Missing station ID")
+		return
+	}
+
+	// Checked as a configuration of its own; arrival times only come
+	// from updates
+	added := &system{Stops: []*station{stop}}
+	if problems := added.validate(); len(problems) > 0 {
+		rejected := updateErrors{Errors: make([]string, len(problems))}
+		for i, problem := range problems {
+			rejected.Errors[i] = problem.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder(w, r).Encode(rejected)
+		return
+	}
+	for _, lines := range stop.Lines {
+		for _, ln := range lines {
+			ln.Times, ln.TimesAbs, ln.updatedAt = nil, nil, time.Time{}
+		}
+	}
+	added.fillDefaults()
+
+	// Obtain a writer lock; appending keeps the station locking order
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopMap[idKey(stop.ID)] != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Duplicate station ID (%s)", stop.ID))
+		return
+	}
+	s.Stops = append(s.Stops, stop)
+	s.indexStops()
+	s.changed()
+	s.notify(nil, nil)
+	slog.InfoContext(r.Context(), "Added station", "handler", "station", "remoteAddr", r.RemoteAddr, "stopID", stop.ID)
+
+	// Send back the station as it is now served
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := jsonEncoder(w, r).Encode(stop.snapshot()); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to encode station", "handler", "station", "error", err)
+	}
+}
+
+// Remove the station named by the id parameter
+func (s *system) removeStation(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "Missing stop ID")
+		return
+	}
+
+	// Obtain a writer lock, so nothing holds the station's lock
+	s.Lock()
+	defer s.Unlock()
+
+	stop := s.stopMap[idKey(id)]
+	if stop == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown stop id (%s)", id))
+		return
+	}
+
+	s.Stops = slices.DeleteFunc(s.Stops, func(st *station) bool { return st == stop })
+	s.indexStops()
+	s.changed()
+	s.disconnect(stop)
+	s.notify(nil, nil)
+	slog.InfoContext(r.Context(), "Removed station", "handler", "station", "remoteAddr", r.RemoteAddr, "stopID", stop.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Whether read endpoints leave a station out. The caller must hold the
+// system lock.
+func (st *station) hidden() bool {
+	return hideOutOfService && st.OutOfService
+}
+
+// Whether a color is usable by the display: hex as #RGB or #RRGGBB
+func isValidColor(c string) bool {
+	if len(c) != 4 && len(c) != 7 || c[0] != '#' {
+		return false
+	}
+	for _, ch := range c[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send the stations and lines as a zip of GTFS-like CSV files, for
+// handing off to other tools
+func (s *system) handleExport(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := s.export(&buf); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to export system", "handler", "export", "remoteAddr", r.RemoteAddr, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+		return
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+	w.Write(buf.Bytes())
+}
+
+// Write stops.csv and routes.csv, zipped, to w. Lines are listed once
+// each, in the same order as /lines.
+func (s *system) export(w io.Writer) error {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("stops.csv")
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"stop_id", "stop_name", "stop_lat", "stop_lon"})
+	seen := make(map[string]bool)
+	lines := []lineSummary{}
+	for _, stop := range s.Stops {
+		cw.Write([]string{
+			stop.ID,
+			stop.Name,
+			strconv.FormatFloat(stop.Coord.Lat, 'f', -1, 64),
+			strconv.FormatFloat(stop.Coord.Lon, 'f', -1, 64),
+		})
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				if !seen[ln.ID] {
+					seen[ln.ID] = true
+					lines = append(lines, lineSummary{ln.ID, ln.Name, ln.Color})
+				}
+			}
+		}
+	}
+	if cw.Flush(); cw.Error() != nil {
+		return cw.Error()
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Name != lines[j].Name {
+			return lines[i].Name < lines[j].Name
+		}
+		return lines[i].ID < lines[j].ID
+	})
+
+	// GTFS colors are bare hex, the reverse of -gtfsStatic
+	f, err = zw.Create("routes.csv")
+	if err != nil {
+		return err
+	}
+	cw = csv.NewWriter(f)
+	cw.Write([]string{"route_id", "route_short_name", "route_color"})
+	for _, ln := range lines {
+		cw.Write([]string{ln.ID, ln.Name, strings.TrimPrefix(ln.Color, "#")})
+	}
+	if cw.Flush(); cw.Error() != nil {
+		return cw.Error()
+	}
+
+	return zw.Close()
+}
+
+// Handle update request
+func (s *system) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	// Ensure we are dealing with a POST request
+	if r.Method != "POST" {
+		serve(w, "update.html", http.StatusBadRequest)
+		return
+	}
+
+	// Check the API key before looking at the body
+	if !authorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized update", "handler", "update", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	// Turn feeders away rather than queueing them when too many are
+	// already being processed
+	if updateSlots != nil {
+		select {
+		case updateSlots <- struct{}{}:
+			defer func() { <-updateSlots }()
+		default:
+			slog.WarnContext(r.Context(), "Too many concurrent updates", "handler", "update", "remoteAddr", r.RemoteAddr)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Too many updates in progress")
+			return
+		}
+	}
+
+	// Decode the JSON, refusing to read more than a sane amount
+	var new update
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = decodeUpdate(body, &new)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			slog.InfoContext(r.Context(), "Oversized update", "handler", "update", "remoteAddr", r.RemoteAddr, "limit", tooLarge.Limit)
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Updates are limited to %d bytes", tooLarge.Limit))
+			return
+		}
+
+		// People posting the form get a page; scripts get the reason
+		slog.InfoContext(r.Context(), "Malformed update", "handler", "update", "remoteAddr", r.RemoteAddr, "error", err)
+		if wantsHTML(r) {
+			serve(w, "badupdate.html", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder(w, r).Encode(apiError{Error: "malformed json", Detail: err.Error()})
+		return
+	}
+
+	// Try to apply the updates; a dry run only checks them, as does
+	// buffering them to be coalesced
+	dryRun := r.URL.Query().Get("dryRun") == "true" || r.Header.Get("X-Dry-Run") == "true"
+	queued := coalesceWindow > 0 && !dryRun
+	summary, err := s.processUpdates(&new, dryRun || queued)
+	if err != nil {
+		slog.InfoContext(r.Context(), "Rejected update", "handler", "update", "remoteAddr", r.RemoteAddr, "error", err)
+
+		// Every problem found is listed
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder(w, r).Encode(updateErrors{Errors: summary.Errors})
+		return
+	}
+	if queued {
+		s.buffer(&new)
+		summary.DryRun, summary.Queued = false, true
+	}
+
+	// Webhooks only carry the main system's updates; coalesced ones
+	// are passed on once applied
+	if !dryRun && !queued && summary.LinesUpdated > 0 && s == &mainSystem {
+		forward(&new)
+	}
+	if !dryRun {
+		audit(r, summary)
+	}
+
+	// Report what was touched
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(summary); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Stream updates to a client as server-sent events
+func (s *system) handleStream(w http.ResponseWriter, r *http.Request) {
+	// Check for a valid station filter
+	stationID := r.URL.Query().Get("id")
+	if stationID != "" {
+		s.RLock()
+		stop := s.stopMap[idKey(stationID)]
+		hidden := stop != nil && stop.hidden()
+		s.RUnlock()
+
+		if stop == nil || hidden {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid stop id (%s)", stationID))
+			return
+		}
+	}
+
+	sub := s.subscribe(stationID)
+	defer s.unsubscribe(sub)
+
+	// Streams outlive -writeTimeout, so each write gets its own deadline
+	rc := http.NewResponseController(w)
+	extend := func() {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+	}
+	extend()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to stream", "handler", "stream", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			extend()
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.kind, event.data)
+		case <-heartbeat.C:
+			extend()
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Upgrades /ws requests. Browsers may only connect from this server's
+// own origin or one allowed by -corsOrigins, so other sites' pages
+// can't follow it on a visitor's behalf.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: wsOriginAllowed,
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, reason.Error())
+	},
+}
+
+// Whether a WebSocket handshake comes from an allowed origin; clients
+// other than browsers don't send one
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range corsOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// The upgrader needs an http.Hijacker, which the middleware's response
+// writers only reach through Unwrap
+type wsHijacker struct {
+	http.ResponseWriter
+}
+
+func (h wsHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// Stream updates to a client over a WebSocket. Clients may send
+// {"stationID": "..."} at any time to only receive that station's
+// updates, or an empty ID to receive everything.
+func (s *system) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// A failed handshake has already been answered
+	conn, err := wsUpgrader.Upgrade(wsHijacker{w}, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Replies to subscribe requests and events come from different
+	// goroutines, but only one may write at a time
+	var writeMu sync.Mutex
+	write := func(msg []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, msg)
+	}
+	closeWith := func(code int) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(wsWriteTimeout))
+	}
+
+	// Clients answering pings keep the connection open
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+
+	sub := s.subscribe("")
+	defer s.unsubscribe(sub)
+
+	// Handle subscribe requests until the client goes away
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+			var req struct {
+				StationID string `json:"stationID"`
+			}
+			if err := json.Unmarshal(msg, &req); err != nil {
+				write([]byte(`{"error":"Malformed subscribe request"}`))
+				continue
+			}
+
+			s.RLock()
+			stop := s.stopMap[idKey(req.StationID)]
+			hidden := stop != nil && stop.hidden()
+			s.RUnlock()
+			if req.StationID != "" && (stop == nil || hidden) {
+				reply, _ := json.Marshal(map[string]string{
+					"error": fmt.Sprintf("Invalid stop id (%s)", req.StationID),
+				})
+				write(reply)
+				continue
+			}
+
+			s.refilter(sub, req.StationID)
+		}
+	}()
+
+	// Pings keep idle displays from being reaped
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+			closeWith(websocket.CloseGoingAway)
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				closeWith(websocket.CloseNormalClosure)
+				return
+			}
+			err = write(fmt.Appendf(nil, `{"type":%q,"data":%s}`, event.kind, event.data))
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Build information reported by /version
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Which build this server is running
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(buildInfo{version, commit, buildDate}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Liveness; if this answers at all, the server is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	// Obtain a read lock for the system
+	mainSystem.RLock()
+	defer mainSystem.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// Show the configuration as loaded, without live times, for working
+// out why a display misbehaves
+func (s *system) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	if !debugAuthorized(r) {
+		slog.WarnContext(r.Context(), "Unauthorized debug request", "handler", "debugConfig", "remoteAddr", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	snap := s.snapshot()
+	s.RUnlock()
+
+	for _, stop := range snap.Stops {
+		for _, lines := range stop.Lines {
+			for _, ln := range lines {
+				ln.Times, ln.TimesAbs, ln.Display, ln.UpdatedAt = nil, nil, nil, nil
+			}
+		}
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := jsonEncoder(w, r).Encode(snap); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+	}
+}
+
+// Readiness of the server to handle traffic
+type readiness struct {
+	Ready         bool       `json:"ready"`
+	ConfigLoaded  bool       `json:"configLoaded"`
+	LastUpdate    *time.Time `json:"lastUpdate"`
+	LastUpdateAge *float64   `json:"lastUpdateAgeSeconds"`
+}
+
+// Readiness; the configuration must be loaded and, if a staleness
+// threshold is set, an update must have arrived recently enough
+func (s *system) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := s.readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := jsonEncoder(w, r).Encode(status); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to encode readiness", "handler", "readyz", "error", err)
+	}
+}
+
+// Readiness of every system, when there are several; the server is
+// only ready if all of them are
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Ready   bool                 `json:"ready"`
+		Systems map[string]readiness `json:"systems"`
+	}{true, make(map[string]readiness)}
+	for _, h := range systems {
+		ready := h.sys.readiness()
+		status.Systems[h.name] = ready
+		status.Ready = status.Ready && ready.Ready
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := jsonEncoder(w, r).Encode(status); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to encode readiness", "handler", "readyz", "error", err)
+	}
+}
+
+func (s *system) readiness() readiness {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	status := readiness{ConfigLoaded: s.loaded}
+	status.Ready = status.ConfigLoaded
+
+	// Before the first update, staleness counts from startup
+	since := startTime
+	if nanos := s.lastUpdate.Load(); nanos != 0 {
+		last := time.Unix(0, nanos).In(timeZone)
+		age := time.Since(last).Seconds()
+		status.LastUpdate, status.LastUpdateAge = &last, &age
+		since = last
+	}
+	if staleThreshold > 0 && time.Since(since) > staleThreshold {
+		status.Ready = false
+	}
+
+	return status
+}
+
+// Check that a request carries the update key, if one is required
+func authorized(r *http.Request) bool {
+	return keyMatches(r, updateKey)
+}
+
+// Check that a request carries the debug key, or the update key if
+// there isn't one
+func debugAuthorized(r *http.Request) bool {
+	if debugKey == "" {
+		return authorized(r)
+	}
+	return keyMatches(r, debugKey)
+}
+
+func keyMatches(r *http.Request, want string) bool {
+	if want == "" {
+		return true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	return subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+}
+
+// A validated write waiting to be applied
+type pendingUpdate struct {
+	stop  *station
+	ln    *line
+	index int
+	times []int
+	abs   []int64
+}
+
+// Why a request failed
+type apiError struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Why an update was rejected
+type updateErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// Validate and apply an update. In a dry run only the validation
+// happens; the summary says what would have changed. A rejected
+// update's summary lists every problem, which the error joins.
+func (s *system) processUpdates(u *update, dryRun bool) (updateSummary, error) {
+	defer mainMetrics.observeUpdate(time.Now())
+
+	// Obtain a read lock for the system; only the stations being
+	// updated are locked for writing
+	s.RLock()
+	defer s.RUnlock()
+
+	// Validate the entire update before touching anything, so that a
+	// bad entry anywhere in the batch leaves the system untouched.
+	// Every problem is reported, up to a limit, so feeders can fix a
+	// whole batch at once.
+	var pending []pendingUpdate
+	var problems []error
+	stations := make(map[*station]bool)
+	now := time.Now()
+	reject := func(err error) (full bool) {
+		problems = append(problems, err)
+		return len(problems) == maxUpdateErrors
+	}
+validation:
+	for _, su := range u.Stops {
+		stop := s.stopMap[idKey(su.StationID)]
+		if stop == nil {
+			if reject(fmt.Errorf("Invalid station ID (%s)", su.StationID)) {
+				break validation
+			}
+			continue
+		}
+		stations[stop] = true
+
+		for _, lu := range su.Lines {
+			if lu.Index < 0 || lu.Index >= len(stop.Lines) {
+				if reject(fmt.Errorf("Line index out of bounds (%d) for station %s, line %s", lu.Index, su.StationID, lu.LineID)) {
+					break validation
+				}
+				continue
+			}
+
+			if len(stop.Lines[lu.Index]) == 0 {
+				if reject(fmt.Errorf("No lines configured for station %s, direction %d", su.StationID, lu.Index)) {
+					break validation
+				}
+				continue
+			}
+
+			// The ID wins when both are given
+			var ln *line
+			if lu.LineID == "" && lu.LineName != "" {
+				var matches int
+				if ln, matches = findLineByName(stop.Lines[lu.Index], lu.LineName); ln == nil {
+					err := fmt.Errorf("Invalid line name (%s) for station %s, index %d", lu.LineName, su.StationID, lu.Index)
+					if matches > 1 {
+						err = fmt.Errorf("Ambiguous line name (%s, %d lines) for station %s, index %d", lu.LineName, matches, su.StationID, lu.Index)
+					}
+					if reject(err) {
+						break validation
+					}
+					continue
+				}
+				lu.LineID = ln.ID
+			} else if ln = findLine(stop.Lines[lu.Index], lu.LineID); ln == nil {
+				if reject(fmt.Errorf("Invalid line ID (%s) for station %s, index %d", lu.LineID, su.StationID, lu.Index)) {
+					break validation
+				}
+				continue
+			}
+
+			// Absolute times win over minutes; either way they are
+			// checked as minutes from now
+			times := lu.Times
+			if lu.TimesAbs != nil {
+				times = make([]int, len(lu.TimesAbs))
+				for i, ts := range lu.TimesAbs {
+					times[i] = minutesUntil(ts, now)
+				}
+			}
+
+			// Oversized updates are rejected rather than truncated, so
+			// feeders find out they are misbehaving
+			if maxTimes > 0 && len(times) > maxTimes {
+				if reject(fmt.Errorf("Too many times (%d, max %d) for station %s, line %s", len(times), maxTimes, su.StationID, lu.LineID)) {
+					break validation
+				}
+			}
+
+			// A TimeMax of zero means times aren't capped; anything
+			// already gone is dropped rather than rejected
+			for _, t := range times {
+				if s.TimeMax > 0 && t > s.TimeMax {
+					if reject(fmt.Errorf("Time out of range (%d) for station %s, line %s", t, su.StationID, lu.LineID)) {
+						break validation
+					}
+				}
+			}
+
+			// Closed stations may be left as they are, once the
+			// update is known to be good
+			if ignoreOutOfService && stop.OutOfService {
+				continue
+			}
+			pending = append(pending, pendingUpdate{stop, ln, lu.Index, times, lu.TimesAbs})
+		}
+	}
+	if len(problems) > 0 {
+		rejected := updateSummary{Errors: make([]string, len(problems))}
+		for i, problem := range problems {
+			rejected.Errors[i] = problem.Error()
+		}
+		return rejected, errors.Join(problems...)
+	}
+
+	// Everything checks out; apply the writes with every affected
+	// station locked, so readers see all of the update or none of it
+	updated := now.UTC()
+	changed := make(map[*station]bool)
+	changedLines := make(map[*line]bool)
+	var audited []changedLine
+	lines := 0
+	s.lockStations(stations)
+	for _, p := range pending {
+		// Feeders don't always send times in order; soonest goes first
+		times := make([]int, len(p.times))
+		copy(times, p.times)
+		sort.Ints(times)
+
+		var abs []int64
+		if p.abs != nil {
+			abs = make([]int64, len(p.abs))
+			copy(abs, p.abs)
+			sort.Slice(abs, func(i, j int) bool { return abs[i] < abs[j] })
+		}
+
+		// Vehicles that have already left aren't worth showing. The
+		// minutes follow the timestamps, so both sort the same way.
+		expired := 0
+		for expired < len(times) && times[expired] <= expiredThreshold {
+			expired++
+		}
+		times = times[expired:]
+		if abs != nil {
+			abs = abs[expired:]
+		}
+
+		// Feeders resend the same times all the time; leave those
+		// lines alone so subscribers only hear about real changes.
+		// Absolute times are compared as sent, since the minutes
+		// drift with the clock. An empty timesAbs still clears a line
+		// holding minutes, whose timestamps were only worked out from
+		// them. A line's first update always counts.
+		if abs != nil && p.ln.absolute && slices.Equal(abs, p.ln.TimesAbs) {
+			continue
+		}
+		if abs == nil && !p.ln.absolute && !p.ln.updatedAt.IsZero() && slices.Equal(times, p.ln.Times) {
+			continue
+		}
+		changed[p.stop] = true
+		changedLines[p.ln] = true
+		audited = append(audited, changedLine{StationID: p.stop.ID, LineID: p.ln.ID, Index: p.index})
+		lines++
+		if dryRun {
+			continue
+		}
+
+		// Timestamps are kept for minutes too, fixed when they arrive
+		// rather than moving with every read
+		p.ln.Times = times
+		p.ln.TimesAbs = abs
+		p.ln.absolute = abs != nil
+		if abs == nil {
+			p.ln.TimesAbs = timestampsFrom(times, now)
+		}
+		p.ln.updatedAt = updated
+	}
+	s.unlockStations(stations)
+
+	if dryRun {
+		return updateSummary{StationsUpdated: len(changed), LinesUpdated: lines, DryRun: true, system: s.Name, changed: audited}, nil
+	}
+
+	s.lastUpdate.Store(now.UnixNano())
+	if lines > 0 {
+		s.changed()
+		s.scheduleTick(now)
+		s.notify(changed, changedLines)
+	}
+
+	return updateSummary{StationsUpdated: len(changed), LinesUpdated: lines, system: s.Name, changed: audited}, nil
+}
+
+// Take a minute off every arrival time, dropping vehicles that have
+// arrived. Lines with absolute times are worked out afresh from the
+// clock instead.
+func (s *system) countdown() {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	touched := make(map[*station]bool)
+	counted := make(map[*line]bool)
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		stop.Lock()
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				if len(ln.Times) == 0 {
+					continue
+				}
+
+				if ln.absolute {
+					ln.Times, ln.TimesAbs = ln.current(now)
+					touched[stop] = true
+					counted[ln] = true
+					continue
+				}
+
+				// Times are sorted, so those dropped come first, and
+				// their timestamps with them
+				times := make([]int, 0, len(ln.Times))
+				for _, t := range ln.Times {
+					if t-1 > expiredThreshold {
+						times = append(times, t-1)
+					}
+				}
+				if len(ln.TimesAbs) >= len(times) {
+					ln.TimesAbs = ln.TimesAbs[len(ln.TimesAbs)-len(times):]
+				}
+				ln.Times = times
+				touched[stop] = true
+				counted[ln] = true
+			}
+		}
+		stop.Unlock()
+	}
+
+	if len(touched) > 0 {
+		s.changed()
+		s.notify(touched, counted)
+	}
+}
+
+// Whole minutes from now until a Unix timestamp, rounded down so a
+// vehicle is never shown as further away than it is
+func minutesUntil(ts int64, now time.Time) int {
+	return int(math.Floor(float64(ts-now.Unix()) / 60))
+}
+
+// Timestamps for arrival times given in minutes from now
+func timestampsFrom(times []int, now time.Time) []int64 {
+	abs := make([]int64, len(times))
+	for i, t := range times {
+		abs[i] = now.Unix() + int64(t)*60
+	}
+	return abs
+}
+
+// A line's arrival times as of now. Lines fed timestamps have their
+// minutes worked out from the clock, leaving out vehicles that have
+// gone; the rest are as stored.
+func (ln *line) current(now time.Time) ([]int, []int64) {
+	if !ln.absolute {
+		return ln.Times, ln.TimesAbs
+	}
+
+	times := make([]int, 0, len(ln.TimesAbs))
+	abs := make([]int64, 0, len(ln.TimesAbs))
+	for _, ts := range ln.TimesAbs {
+		if t := minutesUntil(ts, now); t > expiredThreshold {
+			times = append(times, t)
+			abs = append(abs, ts)
+		}
+	}
+	return times, abs
+}
+
+// When the minutes worked out for a line next change, in Unix seconds,
+// or 0 if they don't. A minute ends the second after a whole number of
+// minutes before the timestamp.
+func (ln *line) nextTick(now time.Time) int64 {
+	var next int64
+	if !ln.absolute {
+		return next
+	}
+	for _, ts := range ln.TimesAbs {
+		if t := minutesUntil(ts, now); t > expiredThreshold {
+			if at := ts - int64(t)*60 + 1; next == 0 || at < next {
+				next = at
+			}
+		}
+	}
+	return next
+}
+
+// Work out when minutes derived from timestamps next change. The caller
+// must hold the system lock.
+func (s *system) scheduleTick(now time.Time) {
+	s.tickMu.Lock()
+	defer s.tickMu.Unlock()
+
+	s.nextTick = 0
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		stop.RLock()
+		for _, dir := range stop.Lines {
+			for _, ln := range dir {
+				if at := ln.nextTick(now); at != 0 && (s.nextTick == 0 || at < s.nextTick) {
+					s.nextTick = at
+				}
+			}
+		}
+		stop.RUnlock()
+	}
+}
+
+// Count the clock moving a derived minute on as a change, so cached
+// bodies and validators keep up with it. The caller must hold the
+// system lock.
+func (s *system) tick() {
+	now := time.Now()
+	s.tickMu.Lock()
+	due := s.nextTick != 0 && now.Unix() >= s.nextTick
+	s.tickMu.Unlock()
+
+	if due {
+		s.changed()
+		s.scheduleTick(now)
+	}
+}
+
+// Hold an accepted update until the next coalesce
+func (s *system) buffer(u *update) {
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+	s.buffered = append(s.buffered, u.Stops...)
+}
+
+// Identifies a line in a buffered update
+type bufferedLine struct {
+	stationID string
+	index     int
+	lineID    string
+	lineName  string
+}
+
+// Merge buffered updates into one, keeping only the latest times sent
+// for each line, in the order they were last sent
+func coalesced(stops []stationUpdate) *update {
+	seen := make(map[bufferedLine]bool)
+	var latest []stationUpdate
+	for i := len(stops) - 1; i >= 0; i-- {
+		su := stops[i]
+		for j := len(su.Lines) - 1; j >= 0; j-- {
+			lu := su.Lines[j]
+			key := bufferedLine{idKey(su.StationID), lu.Index, idKey(lu.LineID), lu.LineName}
+			if lu.LineID != "" {
+				key.lineName = ""
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			latest = append(latest, stationUpdate{StationID: su.StationID, Lines: []lineUpdate{lu}})
+		}
+	}
+	slices.Reverse(latest)
+	return &update{Stops: latest}
+}
+
+// Apply buffered updates every interval until ctx is done, then once
+// more for anything left
+func (s *system) coalesce(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	flush := func() {
+		s.bufferMu.Lock()
+		stops := s.buffered
+		s.buffered = nil
+		s.bufferMu.Unlock()
+		if len(stops) == 0 {
+			return
+		}
+
+		// Each update was checked on arrival, but a reload since
+		// may have removed what it refers to
+		u := coalesced(stops)
+		summary, err := s.processUpdates(u, false)
+		if err != nil {
+			slog.Warn("Unable to apply coalesced updates", "lines", len(u.Stops), "error", err)
+			return
+		}
+		received := 0
+		for _, su := range stops {
+			received += len(su.Lines)
+		}
+		slog.Debug("Applied coalesced updates", "linesReceived", received, "linesApplied", len(u.Stops), "linesUpdated", summary.LinesUpdated)
+		if summary.LinesUpdated > 0 && s == &mainSystem {
+			forward(u)
+		}
+		audit(nil, summary)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Warn when no update has been applied for too long, and again when
+// updates resume, until ctx is done
+func (s *system) watchStale(ctx context.Context, name string, after time.Duration) {
+	ticker := time.NewTicker(after / 4)
+	defer ticker.Stop()
+
+	logger := slog.Default()
+	if name != "" {
+		logger = logger.With("system", name)
+	}
+
+	stale := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			stale = s.checkStale(logger, now, after, stale)
+		}
+	}
+}
+
+// One watchdog check: whether the system is stale at now, given
+// whether it was at the last check
+func (s *system) checkStale(logger *slog.Logger, now time.Time, after time.Duration, wasStale bool) bool {
+	// Before the first update, count from startup
+	last := startTime
+	if nanos := s.lastUpdate.Load(); nanos != 0 {
+		last = time.Unix(0, nanos)
+	}
+
+	age := now.Sub(last)
+	stale := age > after
+	if stale && !wasStale {
+		logger.Warn("No updates received", "lastUpdate", last, "ageSeconds", age.Seconds())
+		mainMetrics.staleEvents.Inc()
+		mainMetrics.stale.Set(1)
+	} else if !stale && wasStale {
+		logger.Info("Updates resumed", "lastUpdate", last)
+		mainMetrics.stale.Set(0)
+	}
+	return stale
+}
+
+// Lock a set of stations for writing, in Stops order so concurrent
+// updates can't deadlock. The caller must hold the system lock.
+func (s *system) lockStations(stations map[*station]bool) {
+	for i := 0; i < len(s.Stops); i++ {
+		if stations[s.Stops[i]] {
+			s.Stops[i].Lock()
+		}
+	}
+}
+
+func (s *system) unlockStations(stations map[*station]bool) {
+	for stop := range stations {
+		stop.Unlock()
+	}
+}
+
+// The system as clients see it: a copy safe to encode without holding
+// any locks
+type systemSnapshot struct {
+	Name    string             `json:"name" msgpack:"name"`
+	Tagline string             `json:"tagline" msgpack:"tagline"`
+	Alert   string             `json:"alert,omitempty" msgpack:"alert,omitempty"`
+	Stops   []*stationSnapshot `json:"stops" msgpack:"stops"`
+	TimeMax int                `json:"timeMax" msgpack:"timeMax"`
+}
+
+type stationSnapshot struct {
+	Name         string                      `json:"name" msgpack:"name"`
+	ID           string                      `json:"id" msgpack:"id"`
+	Coord        coordinates                 `json:"coord" msgpack:"coord"`
+	Alert        string                      `json:"alert,omitempty" msgpack:"alert,omitempty"`
+	OutOfService bool                        `json:"outOfService,omitempty" msgpack:"outOfService,omitempty"`
+	Sequence     int                         `json:"sequence,omitempty" msgpack:"sequence,omitempty"`
+	Directions   [2]string                   `json:"directions" msgpack:"directions"`
+	Lines        [2]map[string]*lineSnapshot `json:"lines" msgpack:"lines"`
+
+	// Line IDs for each direction in the order boards should show them,
+	// since Lines can't keep one
+	LineOrder [][]string `json:"lineOrder,omitempty" msgpack:"lineOrder,omitempty"`
+}
+
+type lineSnapshot struct {
+	line
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" msgpack:"updatedAt,omitempty"` // Last update to the times, in -tz; not moved by -countdown
+}
+
+// Copy of the system safe to encode without holding any station
+// locks. The caller must hold the system lock.
+func (s *system) snapshot() *systemSnapshot {
+	snap := &systemSnapshot{
+		Name:    s.Name,
+		Tagline: s.Tagline,
+		Alert:   s.Alert,
+		Stops:   make([]*stationSnapshot, 0, len(s.Stops)),
+		TimeMax: s.TimeMax,
+	}
+	for i := 0; i < len(s.Stops); i++ {
+		if !s.Stops[i].hidden() {
+			snap.Stops = append(snap.Stops, s.Stops[i].snapshot())
+		}
+	}
+
+	// Stations with a sequence go first, in that order; the rest keep
+	// their configuration order. Stops itself stays as configured,
+	// since it sets the locking order.
+	slices.SortStableFunc(snap.Stops, func(a, b *stationSnapshot) int {
+		switch {
+		case a.Sequence == b.Sequence:
+			return 0
+		case a.Sequence == 0:
+			return 1
+		case b.Sequence == 0:
+			return -1
+		}
+		return cmp.Compare(a.Sequence, b.Sequence)
+	})
+
+	return snap
+}
+
+// Copy of a station safe to encode without holding its lock
+func (st *station) snapshot() *stationSnapshot {
+	st.RLock()
+	defer st.RUnlock()
+
+	now := time.Now()
+	snap := &stationSnapshot{
+		Name:         st.Name,
+		ID:           st.ID,
+		Coord:        st.Coord,
+		Alert:        st.Alert,
+		OutOfService: st.OutOfService,
+		Sequence:     st.Sequence,
+		Directions:   st.Directions,
+		LineOrder:    make([][]string, len(st.Lines)),
+	}
+	for dir, lines := range st.Lines {
+		if lines == nil {
+			continue
+		}
+
+		// Times are always replaced rather than modified in place,
+		// so the copies can share them
+		snap.Lines[dir] = make(map[string]*lineSnapshot, len(lines))
+		for id, ln := range lines {
+			copied := &lineSnapshot{line: *ln}
+			copied.Times, copied.TimesAbs = ln.current(now)
+			copied.Times = inWindow(copied.Times)
+			copied.Display = displayTimes(copied.Times)
+			if len(copied.TimesAbs) > len(copied.Times) {
+				copied.TimesAbs = copied.TimesAbs[:len(copied.Times)]
+			}
+			if !ln.updatedAt.IsZero() {
+				updated := ln.updatedAt.In(timeZone)
+				copied.UpdatedAt = &updated
+			}
+			if !reportTimestamps {
+				copied.TimesAbs = nil
+			}
+			snap.Lines[dir][id] = copied
+		}
+		snap.LineOrder[dir] = lineOrder(lines)
+	}
+
+	return snap
+}
+
+// The arrival times to show, within the display window. Times are kept
+// sorted, so these are the first of them.
+func inWindow(times []int) []int {
+	if window <= 0 {
+		return times
+	}
+	return times[:sort.SearchInts(times, window+1)]
+}
+
+// Arrival times as boards show them: "Due", "1 min" or "N min"
+func displayTimes(times []int) []string {
+	display := make([]string, len(times))
+	for i, t := range times {
+		switch {
+		case t <= dueThreshold:
+			display[i] = "Due"
+		case t == 1:
+			display[i] = "1 min"
+		default:
+			display[i] = strconv.Itoa(t) + " min"
+		}
+	}
+	return display
+}
+
+// IDs of lines ordered by their order, then name, then ID. Lines
+// without an order go after those with one.
+func lineOrder(lines map[string]*line) []string {
+	sorted := make([]*line, 0, len(lines))
+	for _, ln := range lines {
+		sorted = append(sorted, ln)
+	}
+	slices.SortFunc(sorted, func(a, b *line) int {
+		switch {
+		case a.Order == b.Order:
+		case a.Order == 0:
+			return 1
+		case b.Order == 0:
+			return -1
+		default:
+			return cmp.Compare(a.Order, b.Order)
+		}
+		if c := cmp.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	ids := make([]string, len(sorted))
+	for i, ln := range sorted {
+		ids[i] = ln.ID
+	}
+	return ids
+}
+
+// The original payload, for clients from before the fields added since
+type lineV1 struct {
+	Name  string `json:"name" msgpack:"name"`
+	ID    string `json:"id" msgpack:"id"`
+	Times []int  `json:"times" msgpack:"times"`
+	Color string `json:"color" msgpack:"color"`
+}
+
+type stationV1 struct {
+	Name       string                `json:"name" msgpack:"name"`
+	ID         string                `json:"id" msgpack:"id"`
+	Coord      coordinates           `json:"coord" msgpack:"coord"`
+	Directions [2]string             `json:"directions" msgpack:"directions"`
+	Lines      [2]map[string]*lineV1 `json:"lines" msgpack:"lines"`
+}
+
+type systemV1 struct {
+	Name    string       `json:"name" msgpack:"name"`
+	Tagline string       `json:"tagline" msgpack:"tagline"`
+	Stops   []*stationV1 `json:"stops" msgpack:"stops"`
+	TimeMax int          `json:"timeMax" msgpack:"timeMax"`
+}
+
+// Cut a snapshot down to the original fields
+func (s *systemSnapshot) v1() *systemV1 {
+	old := &systemV1{Name: s.Name, Tagline: s.Tagline, Stops: make([]*stationV1, len(s.Stops)), TimeMax: s.TimeMax}
+	for i, stop := range s.Stops {
+		old.Stops[i] = stop.v1()
+	}
+	return old
+}
+
+// Cut a station snapshot down to the original fields
+func (st *stationSnapshot) v1() *stationV1 {
+	old := &stationV1{Name: st.Name, ID: st.ID, Coord: st.Coord, Directions: st.Directions}
+	for dir, lines := range st.Lines {
+		if lines == nil {
+			continue
+		}
+		old.Lines[dir] = make(map[string]*lineV1, len(lines))
+		for id, ln := range lines {
+			old.Lines[dir][id] = &lineV1{Name: ln.Name, ID: ln.ID, Times: ln.Times, Color: ln.Color}
+		}
+	}
+	return old
+}
+
+// Drop the lines for every direction but one from a snapshot
+func (st *stationSnapshot) keepDirection(dir int) {
+	for i := range st.Lines {
+		if i != dir {
+			st.Lines[i] = nil
+			st.LineOrder[i] = nil
+		}
+	}
+}
+
+// Whether the client asked for indented JSON with ?pretty=true
+func wantsPretty(r *http.Request) bool {
+	return r.URL.Query().Get("pretty") == "true"
+}
+
+// Encoder for a JSON response, indented if the client asked for it
+func jsonEncoder(w io.Writer, r *http.Request) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if wantsPretty(r) {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+// Encode a response body the same way json.Encoder would write it
+func encodeJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode as msgpack, for displays that find JSON too heavy. The
+// structs carry msgpack tags matching their JSON ones, so both have the
+// same fields. Map keys are sorted so a version always encodes the same.
+func encodeMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Record that something clients can see has changed, invalidating
+// cached bodies
+func (s *system) changed() {
+	s.modified.Store(time.Now().UnixNano())
+	s.version.Add(1)
+}
+
+// When the system last changed, as far as HTTP dates can tell
+func (s *system) lastModified() time.Time {
+	if nanos := s.modified.Load(); nanos != 0 {
+		return time.Unix(0, nanos).UTC().Truncate(time.Second)
+	}
+	return startTime.UTC().Truncate(time.Second)
+}
+
+// Set Last-Modified, and check whether If-Modified-Since shows the
+// client is up to date. Entity tags take precedence when sent. HTTP
+// dates only have whole seconds, so while the last change is in the
+// current second another could follow it unseen, and neither is sent.
+func notModifiedSince(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if !time.Now().Truncate(time.Second).After(modified) {
+		return false
+	}
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !since.Before(modified)
+}
+
+// Entity tag for a version of the system
+func etag(version uint64) string {
+	return fmt.Sprintf("\"%x-%d\"", epoch, version)
+}
+
+// The encoded /info body and the version it reflects. The encoding is
+// cached until the version changes, so bumping the version is all it
+// takes to invalidate it. The caller must hold the system lock.
+func (s *system) infoJSON() ([]byte, uint64, error) {
+	// Read the version before encoding, so that it can only ever
+	// understate what the body contains
+	version := s.version.Load()
+
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+
+	if s.info != nil && s.infoVersion == version {
+		return s.info, version, nil
+	}
+
+	body, err := encodeJSON(s.snapshot())
+	if err != nil {
+		return nil, 0, err
+	}
+	s.info, s.infoVersion = body, version
+	return s.info, version, nil
+}
+
+// Check whether If-None-Match names the given entity tag
+func etagMatches(r *http.Request, etag string) bool {
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Start following a station, or the whole system if stationID is
+// empty, beginning with a snapshot of it
+func (s *system) subscribe(stationID string) *subscriber {
+	sub := &subscriber{stationID, make(chan streamEvent, streamBuffer)}
+
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[*subscriber]bool)
+	}
+	s.subscribers[sub] = true
+	s.sendSnapshot(sub)
+	return sub
+}
+
+func (s *system) unsubscribe(sub *subscriber) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	delete(s.subscribers, sub)
+}
+
+// Disconnect every subscriber following one station, which is going
+// away. The caller must hold the system lock.
+func (s *system) disconnect(stop *station) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	for sub := range s.subscribers {
+		if sub.stationID != "" && idKey(sub.stationID) == idKey(stop.ID) {
+			delete(s.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Change which station a subscriber hears about, sending a snapshot of
+// it. Deltas for the old one may still be queued ahead of it.
+func (s *system) refilter(sub *subscriber, stationID string) {
+	// Obtain a read lock for the system
+	s.RLock()
+	defer s.RUnlock()
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	// Already disconnected, with its events closed
+	if !s.subscribers[sub] {
+		return
+	}
+
+	sub.stationID = stationID
+	s.sendSnapshot(sub)
+}
+
+// Queue a snapshot of whatever a subscriber follows. The caller must
+// hold the system lock and subMu.
+func (s *system) sendSnapshot(sub *subscriber) {
+	var data []byte
+	var err error
+	if sub.stationID == "" {
+		data, err = json.Marshal(s.snapshot())
+	} else if stop := s.stopMap[idKey(sub.stationID)]; stop != nil && !stop.hidden() {
+		data, err = json.Marshal(stop.snapshot())
+	} else {
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to encode event", "error", err)
+		return
+	}
+	s.send(sub, streamEvent{"snapshot", data})
+}
+
+// Queue an event, never blocking an update on a slow client. The
+// caller must hold subMu.
+func (s *system) send(sub *subscriber, event streamEvent) {
+	select {
+	case sub.events <- event:
+	default:
+		slog.Warn("Dropping event for slow subscriber", "stopID", sub.stationID)
+	}
+}
+
+// Tell subscribers about a change. Deltas carry the touched stations
+// with just the given lines, or all of their lines if lines is nil; if
+// touched is nil, the structure changed and everyone gets a snapshot.
+// The caller must hold the system lock, but no station locks.
+func (s *system) notify(touched map[*station]bool, lines map[*line]bool) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	if touched == nil {
+		for sub := range s.subscribers {
+			s.sendSnapshot(sub)
+		}
+		return
+	}
+
+	// Everything is encoded at most once, however many are listening
+	var whole []byte
+	encoded := make(map[*station][]byte)
+	for sub := range s.subscribers {
+		var event []byte
+		var err error
+		if sub.stationID == "" {
+			if whole == nil {
+				delta := systemDelta{Stops: []*stationSnapshot{}}
+				for _, stop := range s.Stops {
+					if touched[stop] && !stop.hidden() {
+						delta.Stops = append(delta.Stops, stop.delta(lines))
+					}
+				}
+				whole, err = json.Marshal(delta)
+			}
+			event = whole
+		} else {
+			stop := s.stopMap[idKey(sub.stationID)]
+			if !touched[stop] || stop.hidden() {
+				continue
+			}
+			if encoded[stop] == nil {
+				encoded[stop], err = json.Marshal(stop.delta(lines))
+			}
+			event = encoded[stop]
+		}
+		if err != nil {
+			slog.Error("Unable to encode event", "error", err)
+			continue
+		}
+
+		s.send(sub, streamEvent{"delta", event})
+	}
+}
+
+// Copy of a station with only the given lines, or all of them if lines
+// is nil. The caller must hold the system lock.
+func (st *station) delta(lines map[*line]bool) *stationSnapshot {
+	snap := st.snapshot()
+	if lines == nil {
+		return snap
+	}
+	for dir := range st.Lines {
+		for id, ln := range st.Lines[dir] {
+			if !lines[ln] {
+				delete(snap.Lines[dir], id)
+			}
+		}
+	}
+	return snap
+}
+
+// Whether a point is on the globe. NaN fails every comparison, so it
+// has to be ruled out by name.
+func (c coordinates) valid() bool {
+	if math.IsNaN(c.Lat) || math.IsNaN(c.Lon) || math.IsInf(c.Lat, 0) || math.IsInf(c.Lon, 0) {
+		return false
+	}
+	return c.Lat >= -90 && c.Lat <= 90 && c.Lon >= -180 && c.Lon <= 180
+}
+
+// Great-circle distance between two points, in meters
+func haversine(a, b coordinates) float64 {
+	const rad = math.Pi / 180
+
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Normalize a name for searching: lower case, without accents
+func foldName(name string) string {
+	return accentFolder.Replace(strings.ToLower(name))
+}
+
+// Number of single rune edits needed to turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// NewHandler serves a configuration file the way Main would with the
+// given flags, for tests of programs that talk to the server, such as
+// feeders. Nothing runs in the background, so flags such as -feedURL do
+// nothing. The settings are shared by the whole package, so only the
+// latest handler may be used.
+func NewHandler(configFile string, args ...string) (http.Handler, error) {
+	fs := flag.NewFlagSet("ltdiy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := o.apply(); err != nil {
+		return nil, err
+	}
+
+	fresh, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	sys := &system{}
+	sys.replace(fresh)
+
+	systems = []*hostedSystem{{source: configFile, sys: sys}}
+	mux = http.NewServeMux()
+	setupRoutes()
+	return mux, nil
+}
+
+// Route every system and the server's own endpoints; with several
+// systems, each one's routes are under its name
+func setupRoutes() {
+	for _, h := range systems {
+		prefix := ""
+		if h.name != "" {
+			prefix = "/" + h.name
+		}
+		h.sys.routes(prefix)
+	}
+	if len(systems) > 1 {
+		handle("/readyz", "readyz", handleReadyz)
+	}
+	handle("/healthz", "healthz", handleHealthz)
+	handle("/version", "version", handleVersion)
+	handle("/static/", "static", http.StripPrefix(basePath+"/static/", http.FileServer(noListing{http.Dir(staticDirectory)})).ServeHTTP)
+	mux.HandleFunc(basePath+"/metrics", logRequests(recovered(handleMetrics)))
+}
+
+// Register the routes for a system's information and updates
+func (s *system) routes(prefix string) {
+	handle(prefix+"/info", "info", cached(gzipped(jsonp(s.handleInfo))))
+	handle(prefix+"/update", "update", idempotent(rateLimited(s.handleUpdate)))
+	handle(prefix+"/stop", "stop", cached(gzipped(jsonp(s.handleStopInfo))))
+	handle(prefix+"/stop/next", "stopNext", gzipped(s.handleStopNext))
+	handle(prefix+"/stop/directions", "stopDirections", s.handleStopDirections)
+	handle(prefix+"/stop/batch", "stopBatch", gzipped(s.handleStopBatch))
+	handle(prefix+"/nearest", "nearest", s.handleNearest)
+	handle(prefix+"/lines", "lines", cached(s.handleLines))
+	handle(prefix+"/lines/near", "linesNear", s.handleLinesNear)
+	handle(prefix+"/line", "line", s.handleLineInfo)
+	handle(prefix+"/line/color", "lineColor", s.handleLineColor)
+	handle(prefix+"/alert", "alert", s.handleAlert)
+	handle(prefix+"/station", "station", s.handleStation)
+	handle(prefix+"/station/service", "stationService", s.handleStationService)
+	handle(prefix+"/stops", "stops", s.handleStops)
+	handle(prefix+"/stops/bbox", "stopsBBox", s.handleStopsBBox)
+	handle(prefix+"/export", "export", s.handleExport)
+	handle(prefix+"/search", "search", s.handleSearch)
+	handle(prefix+"/stream", "stream", s.handleStream)
+	handle(prefix+"/ws", "ws", s.handleWebSocket)
+	handle(prefix+"/stats", "stats", s.handleStats)
+	handle(prefix+"/readyz", "readyz", s.handleReadyz)
+	handle(prefix+"/debug/config", "debugConfig", s.handleDebugConfig)
+}
+
+// Register a handler, under -basePath, along with the standard
+// middleware
+func handle(pattern, name string, h http.HandlerFunc) {
+	mux.HandleFunc(basePath+pattern, logRequests(instrument(name, recovered(cors(h)))))
+}
+
+// Allow cross-origin requests from the configured origins, answering
+// preflight requests directly
+func cors(h http.HandlerFunc) http.HandlerFunc {
+	if len(corsOrigins) == 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		for _, o := range corsOrigins {
+			if o == "*" || o == origin {
+				allowed = o
+				break
+			}
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || allowed == "" {
+			h(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed")
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Dry-Run, X-Request-ID, Idempotency-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// Captures the status code written by a handler; a handler that never
+// calls WriteHeader has implicitly sent a 200
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wrote {
+		sr.status = code
+		sr.wrote = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wrote = true
+	return sr.ResponseWriter.Write(b)
+}
+
+// Allows http.ResponseController to reach the original writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Longest inbound X-Request-ID kept; anything longer is replaced
+const maxRequestID = 128
+
+// Context key for the request's ID
+type requestIDKey struct{}
+
+// The ID given to the request a context belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Adds the request ID, when the context has one, to each record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("requestID", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// The request's ID: the proxy's X-Request-ID if it sent a sensible one,
+// otherwise a new random one
+func newRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	valid := id != "" && len(id) <= maxRequestID
+	for i := 0; valid && i < len(id); i++ {
+		valid = id[i] > ' ' && id[i] < 0x7f
+	}
+	if valid {
+		return id
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b)
+}
+
+// Log one line per request, under an ID that is also sent back as
+// X-Request-ID and logged with anything else the request logs
+func logRequests(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID(r)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sr, r)
+
+		slog.InfoContext(r.Context(), "Request",
+			"method", r.Method,
+			"url", r.URL.String(),
+			"remoteAddr", r.RemoteAddr,
+			"status", sr.status,
+			"duration", time.Since(start))
+	}
+}
+
+// Turn a panicking handler into a 500 for that request alone, rather
+// than losing the connection without a word
+func recovered(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// Deliberate aborts are for the server to handle
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			slog.ErrorContext(r.Context(), "Handler panicked", "url", r.URL.String(), "remoteAddr", r.RemoteAddr, "panic", err, "stack", string(debug.Stack()))
+			if !sr.wrote {
+				writeError(sr, http.StatusInternalServerError, "Internal Server Error")
+			}
+		}()
+		h(sr, r)
+	}
+}
+
+// Adds Cache-Control to successful and not modified responses, so
+// errors aren't cached
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (c *cacheResponseWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusNotModified {
+			c.Header().Set("Cache-Control", cacheControl)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *cacheResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Let caches keep a read for as long as -cacheControl says; /info and
+// /stop can then be revalidated with their ETag or Last-Modified
+func cached(h http.HandlerFunc) http.HandlerFunc {
+	if cacheControl == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(&cacheResponseWriter{ResponseWriter: w}, r)
+	}
+}
+
+// Wraps a successful JSON response in a call to the callback
+type jsonpResponseWriter struct {
+	http.ResponseWriter
+	callback    string
+	wroteHeader bool
+	wrapped     bool
+}
+
+func (j *jsonpResponseWriter) WriteHeader(code int) {
+	if j.wroteHeader {
+		return
+	}
+	j.wroteHeader = true
+
+	// Errors, 304s and msgpack go out as they are
+	if code == http.StatusOK && strings.HasPrefix(j.Header().Get("Content-Type"), "application/json") {
+		j.wrapped = true
+		j.Header().Set("Content-Type", "application/javascript")
+		j.Header().Set("X-Content-Type-Options", "nosniff")
+		j.ResponseWriter.WriteHeader(code)
+
+		// The leading comment stops the body being read as anything
+		// other than script
+		io.WriteString(j.ResponseWriter, "/**/"+j.callback+"(")
+		return
+	}
+	j.ResponseWriter.WriteHeader(code)
+}
+
+func (j *jsonpResponseWriter) Write(b []byte) (int, error) {
+	if !j.wroteHeader {
+		j.WriteHeader(http.StatusOK)
+	}
+	return j.ResponseWriter.Write(b)
+}
+
+func (j *jsonpResponseWriter) Unwrap() http.ResponseWriter {
+	return j.ResponseWriter
+}
+
+// Serve JSONP to browsers that can't use CORS when -allowJSONP is set
+// and the request names a callback
+func jsonp(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callback := r.URL.Query().Get("callback")
+		if !allowJSONP || callback == "" {
+			h(w, r)
+			return
+		}
+		if !jsonpCallback.MatchString(callback) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid callback (%s)", callback))
+			return
+		}
+
+		jw := &jsonpResponseWriter{ResponseWriter: w, callback: callback}
+		h(jw, r)
+		if jw.wrapped {
+			io.WriteString(w, ");")
+		}
+	}
+}
+
+// Compresses a response once its status is known to allow a body,
+// unless the handler has already encoded it
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if !g.wroteHeader {
+		g.wroteHeader = true
+		if code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified && g.Header().Get("Content-Encoding") == "" {
+			g.Header().Set("Content-Encoding", "gzip")
+			g.Header().Del("Content-Length")
+			g.gz = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Gzip responses for clients that ask for it
+func gzipped(h http.HandlerFunc) http.HandlerFunc {
+	if !gzipEnabled {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		h(gw, r)
+		if gw.gz != nil {
+			gw.gz.Close()
+		}
+	}
+}
+
+// Check whether gzip is among the acceptable encodings
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			// An explicit zero quality means "not gzip"
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// Token buckets per client IP. Each client may make burst requests at
+// once, refilled at rate per second.
+type rateLimiter struct {
+	sync.Mutex
+
+	rate    rate.Limit
+	burst   int
+	clients map[string]*rate.Limiter
+}
+
+func newRateLimiter(r float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate.Limit(r),
+		burst:   burst,
+		clients: make(map[string]*rate.Limiter),
+	}
+}
+
+// Take a token for a client, or report how long until one is available
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	lim := l.clients[client]
+	if lim == nil {
+		lim = rate.NewLimiter(l.rate, l.burst)
+		l.clients[client] = lim
+	}
+
+	// Reserving says how long the token would take; turned away
+	// clients give it back
+	res := lim.ReserveN(now, 1)
+	if wait := res.DelayFrom(now); wait > 0 {
+		res.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+// Forget clients whose buckets have refilled, so the map only holds
+// recent ones
+func (l *rateLimiter) sweep(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.Lock()
+			for client, lim := range l.clients {
+				if lim.TokensAt(now) >= float64(l.burst) {
+					delete(l.clients, client)
+				}
+			}
+			l.Unlock()
+		}
+	}
+}
+
+// Turn away clients making requests faster than the update rate limit
+func rateLimited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if updateLimiter == nil {
+			h(w, r)
+			return
+		}
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, wait := updateLimiter.allow(client, time.Now()); !ok {
+			slog.InfoContext(r.Context(), "Rate limited", "remoteAddr", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "Slow down")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// The response to a request with an Idempotency-Key. Entries are
+// claimed before the request is handled; done is closed once the
+// response is filled in.
+type idempotentResponse struct {
+	key         string
+	stored      time.Time
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+}
+
+// Responses by key, least recently used first, each kept for up to
+// ttl and at most max of them
+type idempotencyCache struct {
+	sync.Mutex
+
+	ttl     time.Duration
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Find the response for a key, or claim the key if there isn't one;
+// claimed reports which. A claimed key must be finished.
+func (c *idempotencyCache) claim(key string, now time.Time) (resp *idempotentResponse, claimed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e := c.entries[key]; e != nil {
+		resp = e.Value.(*idempotentResponse)
+		if now.Sub(resp.stored) < c.ttl {
+			c.order.MoveToBack(e)
+			return resp, false
+		}
+		c.remove(e)
+	}
+
+	// Make room, dropping anything stale on the way
+	for c.order.Len() >= c.max || c.order.Len() > 0 && now.Sub(c.order.Front().Value.(*idempotentResponse).stored) >= c.ttl {
+		c.remove(c.order.Front())
+	}
+
+	resp = &idempotentResponse{key: key, stored: now, done: make(chan struct{})}
+	c.entries[key] = c.order.PushBack(resp)
+	return resp, true
+}
+
+// Record the response to a claimed key. Only successes are kept;
+// anything else releases the key so a retry is handled afresh.
+func (c *idempotencyCache) finish(resp *idempotentResponse, status int, contentType string, body []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	resp.status, resp.contentType, resp.body = status, contentType, body
+	close(resp.done)
+	if e := c.entries[resp.key]; status != http.StatusOK && e != nil && e.Value == resp {
+		c.remove(e)
+	}
+}
+
+func (c *idempotencyCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*idempotentResponse).key)
+}
+
+// Keeps a copy of the status and body written
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *recordingResponseWriter) WriteHeader(code int) {
+	if rr.status == 0 {
+		rr.status = code
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Answer a retried update, recognized by its Idempotency-Key, with the
+// response the first attempt got rather than applying it again. A
+// retry arriving while the first attempt is underway waits for it.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if idempotencyKeys == nil || key == "" || r.Method != "POST" || !authorized(r) {
+			h(w, r)
+			return
+		}
+
+		// Keys belong to one system's updates
+		key = r.URL.Path + " " + key
+		for {
+			resp, claimed := idempotencyKeys.claim(key, time.Now())
+			if claimed {
+				// Finished even if the handler panics, so retries
+				// aren't left waiting
+				rr := &recordingResponseWriter{ResponseWriter: w}
+				defer func() {
+					idempotencyKeys.finish(resp, rr.status, w.Header().Get("Content-Type"), rr.body.Bytes())
+				}()
+				h(rr, r)
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-resp.done:
+			}
+			if resp.status == http.StatusOK {
+				slog.InfoContext(r.Context(), "Replayed update", "handler", "update", "remoteAddr", r.RemoteAddr)
+				w.Header().Set("Content-Type", resp.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.Write(resp.body)
+				return
+			}
+
+			// The first attempt failed, so this one gets its turn
+		}
+	}
+}
+
+// Count requests to a handler by outcome
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sr, r)
+
+		result := "success"
+		if sr.status >= 400 {
+			result = "error"
+		}
+
+		mainMetrics.requests.WithLabelValues(name, result).Inc()
+	}
+}
+
+// Record how long an update took to process
+func (m *metrics) observeUpdate(start time.Time) {
+	m.updateDuration.Observe(time.Since(start).Seconds())
+}
+
+// Count the stations in every system, and their lines once per
+// station and direction, under each system's read lock
+func systemSizes() (stations, lines int) {
+	for _, h := range systems {
+		h.sys.RLock()
+		stations += len(h.sys.Stops)
+		for i := 0; i < len(h.sys.Stops); i++ {
+			for _, dir := range h.sys.Stops[i].Lines {
+				lines += len(dir)
+			}
+		}
+		h.sys.RUnlock()
+	}
+	return stations, lines
+}
+
+// Expose metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	mainMetrics.handler.ServeHTTP(w, r)
+}
+
+// Maps GTFS identifiers onto the ones in our configuration
+type gtfsMapping struct {
+	Stops  map[string]string `json:"stops"`  // GTFS stop_id to station ID
+	Routes map[string]string `json:"routes"` // GTFS route_id to line ID
+
+	warned map[string]bool // Unmapped IDs already logged, so each is only logged once
+}
+
+// A predicted arrival taken from a GTFS-realtime TripUpdate
+type gtfsArrival struct {
+	stopID    string
+	routeID   string
+	direction int
+	time      int64 // Unix seconds
+}
+
+// Largest GTFS-realtime feed that will be read
+const gtfsMaxFeed int64 = 16 << 20
+
+func readGTFSMapping(filename string) (*gtfsMapping, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open GTFS mapping file (%s)", filename)
+	}
+	defer f.Close()
+
+	m := &gtfsMapping{}
+	if jserr := json.NewDecoder(f).Decode(m); jserr != nil {
+		return nil, fmt.Errorf("Malformed json GTFS mapping (%s): %w", filename, jserr)
+	}
+	return m, nil
+}
+
+// Fetch a GTFS-realtime feed on every tick, applying its predictions
+// as updates
+func pollGTFSRealtime(ctx context.Context, url string, interval time.Duration, m *gtfsMapping) {
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fetchGTFSRealtime(ctx, client, url, m); err != nil {
+			slog.Warn("Unable to apply GTFS-realtime feed", "url", url, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetchGTFSRealtime(ctx context.Context, client *http.Client, url string, m *gtfsMapping) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status (%s)", resp.Status)
+	}
+	feed, err := io.ReadAll(io.LimitReader(resp.Body, gtfsMaxFeed))
+	if err != nil {
+		return err
+	}
+
+	arrivals, err := decodeTripUpdates(feed)
+	if err != nil {
+		return err
+	}
+
+	u := m.update(arrivals, time.Now())
+	summary, err := mainSystem.processUpdates(u, false)
+	if err != nil {
+		return err
+	}
+	if summary.LinesUpdated > 0 {
+		forward(u)
+	}
+	slog.Debug("Applied GTFS-realtime feed", "stationsUpdated", summary.StationsUpdated, "linesUpdated", summary.LinesUpdated)
+	return nil
+}
+
+// Turn predicted arrivals into an update. The feed is taken to be
+// complete, so every mapped line that exists in the system is updated,
+// and lines without predictions are emptied. Times are trimmed to what
+// processUpdates will accept.
+func (m *gtfsMapping) update(arrivals []gtfsArrival, now time.Time) *update {
+	type target struct {
+		stationID string
+		index     int
+		lineID    string
+	}
+
+	// Gather predictions in minutes, skipping anything unmapped or
+	// already gone
+	times := make(map[target][]int)
+	unmapped := make(map[string]bool)
+	for _, a := range arrivals {
+		stationID, ok := m.Stops[a.stopID]
+		if !ok {
+			unmapped["stop "+a.stopID] = true
+			continue
+		}
+		lineID, ok := m.Routes[a.routeID]
+		if !ok {
+			unmapped["route "+a.routeID] = true
+			continue
+		}
+
+		minutes := minutesUntil(a.time, now)
+		if minutes < 0 {
+			continue
+		}
+		t := target{stationID, a.direction, lineID}
+		times[t] = append(times[t], minutes)
+	}
+
+	// A missing mapping usually means the feed has new stops or
+	// routes, which is worth hearing about, but not on every poll
+	var ids []string
+	for id := range unmapped {
+		if !m.warned[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		if m.warned == nil {
+			m.warned = make(map[string]bool)
+		}
+		for _, id := range ids {
+			m.warned[id] = true
+		}
+		sort.Strings(ids)
+		slog.Warn("Skipping unmapped GTFS IDs", "ids", ids)
+	}
+
+	mappedStations := make(map[string]bool)
+	for _, id := range m.Stops {
+		mappedStations[id] = true
+	}
+	mappedLines := make(map[string]bool)
+	for _, id := range m.Routes {
+		mappedLines[id] = true
+	}
+
+	// Obtain a read lock for the system
+	mainSystem.RLock()
+	defer mainSystem.RUnlock()
+
+	u := &update{}
+	for i := 0; i < len(mainSystem.Stops); i++ {
+		stop := mainSystem.Stops[i]
+		if !mappedStations[stop.ID] {
+			continue
+		}
+
+		su := stationUpdate{StationID: stop.ID}
+		for dir, lines := range stop.Lines {
+			ids := make([]string, 0, len(lines))
+			for id := range lines {
+				if mappedLines[id] {
+					ids = append(ids, id)
+				}
+			}
+			sort.Strings(ids)
+
+			for _, id := range ids {
+				t := target{stop.ID, dir, id}
+				predicted := times[t]
+				delete(times, t)
+
+				sort.Ints(predicted)
+				kept := []int{}
+				for _, minutes := range predicted {
+					if mainSystem.TimeMax > 0 && minutes > mainSystem.TimeMax {
+						break
+					}
+					if maxTimes > 0 && len(kept) == maxTimes {
+						break
+					}
+					kept = append(kept, minutes)
+				}
+				su.Lines = append(su.Lines, lineUpdate{LineID: id, Index: dir, Times: kept})
+			}
+		}
+
+		if len(su.Lines) > 0 {
+			u.Stops = append(u.Stops, su)
+		}
+	}
+
+	for t := range times {
+		slog.Debug("Skipping GTFS prediction for unknown line", "stopID", t.stationID, "index", t.index, "lineID", t.lineID)
+	}
+
+	return u
+}
+
+// Pull every predicted arrival out of a GTFS-realtime FeedMessage
+func decodeTripUpdates(feed []byte) ([]gtfsArrival, error) {
+	msg := &gtfs.FeedMessage{}
+	if err := proto.Unmarshal(feed, msg); err != nil {
+		return nil, fmt.Errorf("Malformed GTFS-realtime feed: %w", err)
+	}
+
+	var arrivals []gtfsArrival
+	for _, entity := range msg.GetEntity() {
+		tu := entity.GetTripUpdate()
+		routeID := tu.GetTrip().GetRouteId()
+		if routeID == "" {
+			continue
+		}
+		direction := int(tu.GetTrip().GetDirectionId())
+
+		for _, st := range tu.GetStopTimeUpdate() {
+			switch st.GetScheduleRelationship() {
+			case gtfs.TripUpdate_StopTimeUpdate_SKIPPED, gtfs.TripUpdate_StopTimeUpdate_NO_DATA:
+				continue
+			}
+
+			// Prefer the arrival prediction, but a departure will do
+			when := st.GetArrival().GetTime()
+			if when == 0 {
+				when = st.GetDeparture().GetTime()
+			}
+			if st.GetStopId() == "" || when == 0 {
+				continue
+			}
+
+			arrivals = append(arrivals, gtfsArrival{st.GetStopId(), routeID, direction, when})
+		}
+	}
+
+	return arrivals, nil
+}
+
+// Describes where arrival times live in an agency's own JSON feed.
+// Paths are dot separated object keys or array indexes, e.g.
+// "data.arrivals" or "stop.0.id", relative to each record except for
+// Records itself.
+type feedMapping struct {
+	Records string `json:"records"` // Array of records, from the top of the feed
+	Station string `json:"station"` // Station ID
+	Line    string `json:"line"`    // Line ID
+	Index   string `json:"index"`   // Line index; 0 if unset
+	Times   string `json:"times"`   // Arrival time, or an array of them, in minutes
+}
+
+// Largest JSON feed that will be read
+const feedMaxSize int64 = 16 << 20
+
+func readFeedMapping(filename string) (*feedMapping, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open feed mapping file (%s)", filename)
+	}
+	defer f.Close()
+
+	m := &feedMapping{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if jserr := dec.Decode(m); jserr != nil {
+		return nil, fmt.Errorf("Malformed json feed mapping (%s): %w", filename, jserr)
+	}
+	if m.Station == "" || m.Line == "" || m.Times == "" {
+		return nil, fmt.Errorf("Feed mapping (%s) needs station, line and times paths", filename)
+	}
+	return m, nil
+}
+
+// Fetch a JSON feed on every tick, applying its arrival times as
+// updates
+func pollFeed(ctx context.Context, url string, interval time.Duration, m *feedMapping) {
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fetchFeed(ctx, client, url, m); err != nil {
+			slog.Warn("Unable to apply feed", "url", url, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetchFeed(ctx context.Context, client *http.Client, url string, m *feedMapping) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status (%s)", resp.Status)
+	}
+
+	var feed any
+	dec := json.NewDecoder(io.LimitReader(resp.Body, feedMaxSize))
+	dec.UseNumber()
+	if err := dec.Decode(&feed); err != nil {
+		return fmt.Errorf("Malformed json feed: %w", err)
+	}
+
+	u, err := m.update(feed)
+	if err != nil {
+		return err
+	}
+
+	summary, err := mainSystem.processUpdates(u, false)
+	if err != nil {
+		return err
+	}
+	if summary.LinesUpdated > 0 {
+		forward(u)
+	}
+	slog.Debug("Applied feed", "stationsUpdated", summary.StationsUpdated, "linesUpdated", summary.LinesUpdated)
+	return nil
+}
+
+// Turn a decoded feed into an update. Only lines the feed mentions are
+// updated; records for unknown stations or lines are skipped, and times
+// are trimmed to what processUpdates will accept.
+func (m *feedMapping) update(feed any) (*update, error) {
+	records, ok := feedPath(feed, m.Records).([]any)
+	if !ok {
+		return nil, fmt.Errorf("No records array at %q", m.Records)
+	}
+
+	type target struct {
+		stationID string
+		index     int
+		lineID    string
+	}
+
+	// Gather every record's times, keeping the order lines first appear
+	times := make(map[target][]int)
+	var order []target
+	for i, record := range records {
+		stationID, stationOK := feedString(feedPath(record, m.Station))
+		lineID, lineOK := feedString(feedPath(record, m.Line))
+		if !stationOK || !lineOK {
+			slog.Debug("Skipping feed record without station or line", "record", i)
+			continue
+		}
+		index := 0
+		if m.Index != "" {
+			f, ok := feedNumber(feedPath(record, m.Index))
+			if !ok {
+				slog.Debug("Skipping feed record without line index", "record", i)
+				continue
+			}
+			index = int(f)
+		}
+
+		var minutes []int
+		switch v := feedPath(record, m.Times).(type) {
+		case []any:
+			for _, t := range v {
+				if f, ok := feedNumber(t); ok {
+					minutes = append(minutes, int(f))
+				}
+			}
+		default:
+			if f, ok := feedNumber(v); ok {
+				minutes = append(minutes, int(f))
+			}
+		}
+
+		t := target{stationID, index, lineID}
+		if _, seen := times[t]; !seen {
+			order = append(order, t)
+		}
+		times[t] = append(times[t], minutes...)
+	}
+
+	// Obtain a read lock for the system
+	mainSystem.RLock()
+	defer mainSystem.RUnlock()
+
+	u := &update{}
+	stations := make(map[string]int)
+	for _, t := range order {
+		stop := mainSystem.stopMap[idKey(t.stationID)]
+		if stop == nil || t.index < 0 || t.index >= len(stop.Lines) || findLine(stop.Lines[t.index], t.lineID) == nil {
+			slog.Debug("Skipping feed times for unknown line", "stopID", t.stationID, "index", t.index, "lineID", t.lineID)
+			continue
+		}
+
+		predicted := times[t]
+		sort.Ints(predicted)
+		kept := []int{}
+		for _, minutes := range predicted {
+			if minutes < 0 {
+				continue
+			}
+			if mainSystem.TimeMax > 0 && minutes > mainSystem.TimeMax {
+				break
+			}
+			if maxTimes > 0 && len(kept) == maxTimes {
+				break
+			}
+			kept = append(kept, minutes)
+		}
+
+		i, ok := stations[t.stationID]
+		if !ok {
+			i = len(u.Stops)
+			stations[t.stationID] = i
+			u.Stops = append(u.Stops, stationUpdate{StationID: t.stationID})
+		}
+		u.Stops[i].Lines = append(u.Stops[i].Lines, lineUpdate{LineID: t.lineID, Index: t.index, Times: kept})
+	}
+
+	return u, nil
+}
+
+// Follow a dot separated path into decoded JSON, or nil if it leads
+// nowhere. An empty path is v itself.
+func feedPath(v any, path string) any {
+	if path == "" {
+		return v
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// IDs may be given as strings or numbers
+func feedString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// Numbers may also be given as strings
+func feedNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Watch a file for updates, applying it whenever its modification time
+// changes. Feeders on networks that can't reach the server may be able
+// to drop a file on a share.
+func pollUpdateFile(ctx context.Context, filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var applied time.Time
+	missing := false
+	for {
+		info, err := os.Stat(filename)
+		if err != nil {
+			// Only complain once until it turns up
+			if !missing {
+				slog.Warn("Unable to read update file", "file", filename, "error", err)
+			}
+			missing = true
+		} else {
+			missing = false
+			if !info.ModTime().Equal(applied) {
+				// Whatever happens, wait for the file to change again
+				applied = info.ModTime()
+				if err := applyUpdateFile(filename); err != nil {
+					slog.Warn("Unable to apply update file", "file", filename, "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func applyUpdateFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Held to the same size limit and field names as posted updates.
+	// One byte more than allowed is read, to tell a file that is too
+	// large from one that just fits.
+	body, err := io.ReadAll(io.LimitReader(f, maxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBody {
+		return fmt.Errorf("Update file too large (limited to %d bytes)", maxBody)
+	}
+	var u update
+	if err := decodeUpdate(body, &u); err != nil {
+		return fmt.Errorf("Malformed json update: %w", err)
+	}
+
+	summary, err := mainSystem.processUpdates(&u, false)
+	if err != nil {
+		return err
+	}
+	if summary.LinesUpdated > 0 {
+		forward(&u)
+	}
+	slog.Info("Applied update file", "file", filename, "stationsUpdated", summary.StationsUpdated, "linesUpdated", summary.LinesUpdated)
+	return nil
+}
+
+// A flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// A downstream server that accepted updates are forwarded to. Each one
+// has its own queue and goroutine, so a slow server only delays itself.
+type webhook struct {
+	url     string
+	client  *http.Client
+	updates chan []byte
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		updates: make(chan []byte, webhookBuffer),
+	}
+}
+
+// Post queued updates until ctx is done
+func (h *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-h.updates:
+			if err := h.deliver(ctx, body); err != nil {
+				slog.Warn("Unable to forward update", "url", h.url, "error", err)
+			}
+		}
+	}
+}
+
+// Post an update, trying once more if the first attempt fails
+func (h *webhook) deliver(ctx context.Context, body []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(webhookRetryDelay):
+			}
+		}
+
+		if err = h.post(ctx, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if updateKey != "" {
+		req.Header.Set("X-API-Key", updateKey)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status (%s)", resp.Status)
+	}
+	return nil
+}
+
+// Queue an accepted update for every webhook without waiting on any of
+// them; a webhook that has fallen too far behind misses it
+func forward(u *update) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(u)
+	if err != nil {
+		slog.Error("Unable to encode update for webhooks", "error", err)
+		return
+	}
+	for _, h := range webhooks {
+		select {
+		case h.updates <- body:
+		default:
+			slog.Warn("Dropping update for slow webhook", "url", h.url)
+		}
+	}
+}
+
+// Record an accepted update in the audit log, if there is one. Queued
+// updates are recorded again, without a request, once -coalesce has
+// applied them.
+func audit(r *http.Request, summary updateSummary) {
+	if auditLog == nil {
+		return
+	}
+
+	ctx := context.Background()
+	entry := auditEntry{Time: time.Now().In(timeZone), Event: "applied", System: summary.system, Lines: summary.changed}
+	if r != nil {
+		ctx = r.Context()
+		entry.RemoteAddr = r.RemoteAddr
+	}
+	if summary.Queued {
+		entry.Event = "queued"
+	}
+	if entry.Lines == nil {
+		entry.Lines = []changedLine{}
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to encode audit entry", "error", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditLog.Write(append(encoded, '\n')); err != nil {
+		slog.ErrorContext(ctx, "Unable to write audit log", "file", auditLog.Name(), "error", err)
+	}
+}
+
+// Log an error and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Static files, minus directory listings; a directory is only served
+// if it has an index.html
+type noListing struct {
+	http.FileSystem
+}
+
+func (fsys noListing) Open(name string) (http.File, error) {
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		index, err := fsys.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// Report an error to an API client as {"error": "..."}
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiError{Error: msg})
+}
+
+// Whether the request's Accept header lists any of the media types
+func accepts(r *http.Request, mediaTypes ...string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		for _, want := range mediaTypes {
+			if strings.EqualFold(strings.TrimSpace(mediaType), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the request came from a browser
+func wantsHTML(r *http.Request) bool {
+	return accepts(r, "text/html")
+}
+
+// Whether the client wants only the original /info and /stop fields,
+// by asking for them or by not asking for v2 when v1 is the default
+func wantsV1(r *http.Request) bool {
+	switch {
+	case accepts(r, "application/vnd.transit.v2+json"):
+		return false
+	case accepts(r, "application/vnd.transit.v1+json"):
+		return true
+	}
+	return apiVersion == 1
+}
+
+// Whether the client would rather have msgpack than JSON
+func wantsMsgpack(r *http.Request) bool {
+	return accepts(r, "application/msgpack", "application/x-msgpack")
+}
+
+func serve(w http.ResponseWriter, f string, code int) {
+	text, err := ioutil.ReadFile(filepath.Join(staticDirectory, f))
+	if err != nil {
+		slog.Error("Unable to read static file", "file", f, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "500 Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s", text)
+}
+
+// Load every configuration, printing what is wrong with each one.
+// Returns the exit status: zero only if all of them are fine.
+func validateConfigs(configFiles []string, gtfsStatic string) int {
+	status := 0
+	check := func(source string, fresh *system, err error) {
+		if err != nil {
+			fmt.Println(err)
+			status = 1
+			return
+		}
+		fmt.Printf("%s: OK (%d stations)\n", source, len(fresh.Stops))
+	}
+
+	if gtfsStatic != "" {
+		fresh, err := loadGTFS(gtfsStatic)
+		check(gtfsStatic, fresh, err)
+	}
+	for _, filename := range configFiles {
+		fresh, err := loadConfig(filename)
+		check(filename, fresh, err)
+	}
+	return status
+}
+
+// Write a small working configuration to start from: one station,
+// with a line in each direction. It is loaded back before being
+// written, so it is known to work.
+func scaffold(dest string) error {
+	lineTo := func(destination string) map[string]*line {
+		return map[string]*line{"a": {Name: "A Line", ID: "a", Times: []int{}, Color: "#0055a4", Destination: destination}}
+	}
+	s := &system{
+		Name:    "My Transit System",
+		Tagline: "Anytown",
+		TimeMax: 45,
+		Stops: []*station{{
+			Name:       "Main Street",
+			ID:         "main",
+			Coord:      coordinates{Lat: 37.7749, Lon: -122.4194},
+			Directions: [2]string{"Northbound", "Southbound"},
+			Lines:      [2]map[string]*line{lineTo("Uptown"), lineTo("Downtown")},
+		}},
+	}
+
+	body, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	if _, err := parseConfig(bytes.NewReader(body), "scaffold"); err != nil {
+		return err
+	}
+
+	if dest == "-" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	// Never overwrite someone's work
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readConfig(h *hostedSystem) {
+	fresh, err := h.load()
+	if err != nil {
+		fatal("Unable to load configuration", "error", err)
+	}
+
+	if h.name != "" {
+		slog.Info("Using configuration", "config", h.source, "system", h.name)
+	} else {
+		slog.Info("Using configuration", "config", h.source)
+	}
+
+	// No need to worry about live times as the server
+	// hasn't started up yet
+	h.sys.replace(fresh)
+}
+
+// Read a configuration file into a new system, without touching the
+// running one; used both at startup and when reloading
+func loadConfig(filename string) (*system, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open configuration file (%s)", filename)
+	}
+	defer f.Close()
+
+	return parseConfig(f, filename)
+}
+
+// Decode and check a configuration; filename is only for messages
+func parseConfig(f io.Reader, filename string) (*system, error) {
+	s := &system{}
+	dec := json.NewDecoder(f)
+	if strictConfig {
+		dec.DisallowUnknownFields()
+	}
+	if jserr := dec.Decode(s); errors.Is(jserr, io.EOF) {
+		// Same as {}, which validation then deals with
+		s = &system{}
+	} else if jserr != nil {
+		return nil, fmt.Errorf("Malformed json configuration (%s): %w", filename, jserr)
+	}
+
+	if problems := s.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid configuration (%s): %w", filename, errors.Join(problems...))
+	}
+	if s.TimeMax == 0 {
+		slog.Warn("Configuration has no timeMax, so arrival times won't be capped", "file", filename)
+	}
+
+	s.fillDefaults()
+	s.rebuildStopMap()
+	return s, nil
+}
+
+// Fill in what configurations may leave out: a direction left out (or
+// null) simply has no lines, and a line without times has none yet
+func (s *system) fillDefaults() {
+	for _, stop := range s.Stops {
+		for dir := range stop.Lines {
+			if stop.Lines[dir] == nil {
+				stop.Lines[dir] = make(map[string]*line)
+			}
+			for _, ln := range stop.Lines[dir] {
+				if ln.Times == nil {
+					ln.Times = []int{}
+				}
+			}
+		}
+	}
+}
+
+// Build a new system from a GTFS static feed, either a zip file or a
+// directory of its text files. Stops come from stops.txt and lines
+// from routes.txt; which lines serve which stop, in which direction,
+// comes from trips.txt and stop_times.txt.
+func loadGTFS(path string) (*system, error) {
+	var fsys fs.FS
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("Unable to open GTFS feed (%s)", path)
+	} else if info.IsDir() {
+		fsys = os.DirFS(path)
+	} else {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open GTFS feed (%s): %w", path, err)
+		}
+		defer zr.Close()
+		fsys = zr
+	}
+
+	s := &system{}
+	err := readGTFSTable(fsys, "agency.txt", false, func(row map[string]string) error {
+		if s.Name == "" {
+			s.Name = row["agency_name"]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only plain stops; stations, entrances and the like are skipped
+	stops := make(map[string]*station)
+	err = readGTFSTable(fsys, "stops.txt", true, func(row map[string]string) error {
+		if t := row["location_type"]; t != "" && t != "0" {
+			return nil
+		}
+
+		lat, laterr := strconv.ParseFloat(row["stop_lat"], 64)
+		lon, lonerr := strconv.ParseFloat(row["stop_lon"], 64)
+		if laterr != nil || lonerr != nil {
+			return fmt.Errorf("Invalid coordinates for stop %s", row["stop_id"])
+		}
+
+		stop := &station{
+			Name:  row["stop_name"],
+			ID:    row["stop_id"],
+			Coord: coordinates{lat, lon},
+		}
+		for dir := range stop.Lines {
+			stop.Lines[dir] = make(map[string]*line)
+		}
+		stops[stop.ID] = stop
+		s.Stops = append(s.Stops, stop)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]*line)
+	err = readGTFSTable(fsys, "routes.txt", true, func(row map[string]string) error {
+		ln := &line{ID: row["route_id"], Name: row["route_short_name"]}
+		if ln.Name == "" {
+			ln.Name = row["route_long_name"]
+		}
+		if c := row["route_color"]; c != "" {
+			ln.Color = "#" + c
+		}
+		routes[ln.ID] = ln
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type trip struct {
+		routeID   string
+		direction int
+		headsign  string
+	}
+	trips := make(map[string]trip)
+	err = readGTFSTable(fsys, "trips.txt", true, func(row map[string]string) error {
+		t := trip{routeID: row["route_id"], headsign: row["trip_headsign"]}
+		if row["direction_id"] == "1" {
+			t.direction = 1
+		}
+		trips[row["trip_id"]] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Direction labels are each stop's most common headsign, and
+	// destinations each line's there
+	type stopDirection struct {
+		stopID    string
+		direction int
+	}
+	type stopLine struct {
+		stopDirection
+		routeID string
+	}
+	headsigns := make(map[stopDirection]map[string]int)
+	destinations := make(map[stopLine]map[string]int)
+	err = readGTFSTable(fsys, "stop_times.txt", true, func(row map[string]string) error {
+		stop := stops[row["stop_id"]]
+		t, ok := trips[row["trip_id"]]
+		ln := routes[t.routeID]
+		if stop == nil || !ok || ln == nil {
+			return nil
+		}
+
+		if stop.Lines[t.direction][ln.ID] == nil {
+			copied := *ln
+			stop.Lines[t.direction][ln.ID] = &copied
+		}
+		if t.headsign != "" {
+			sd := stopDirection{stop.ID, t.direction}
+			if headsigns[sd] == nil {
+				headsigns[sd] = make(map[string]int)
+			}
+			headsigns[sd][t.headsign]++
+
+			sl := stopLine{sd, ln.ID}
+			if destinations[sl] == nil {
+				destinations[sl] = make(map[string]int)
+			}
+			destinations[sl][t.headsign]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stop := range s.Stops {
+		for dir := range stop.Directions {
+			sd := stopDirection{stop.ID, dir}
+			stop.Directions[dir] = mostCommon(headsigns[sd], gtfsDirections[dir])
+			for id, ln := range stop.Lines[dir] {
+				ln.Destination = mostCommon(destinations[stopLine{sd, id}], "")
+			}
+		}
+	}
+
+	if problems := s.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid GTFS feed (%s): %w", path, errors.Join(problems...))
+	}
+
+	s.fillDefaults()
+	s.rebuildStopMap()
+	return s, nil
+}
+
+// The most frequent of some counted strings, breaking ties
+// alphabetically, or fallback if there are none
+func mostCommon(counts map[string]int, fallback string) string {
+	best, count := fallback, 0
+	for value, n := range counts {
+		if n > count || (n == count && value < best) {
+			best, count = value, n
+		}
+	}
+	return best
+}
+
+// Direction labels for stops without any trip headsigns, following
+// the GTFS convention for direction_id
+var gtfsDirections = [2]string{"Outbound", "Inbound"}
+
+// Call fn for every row of a GTFS table, keyed by column name
+func readGTFSTable(fsys fs.FS, name string, required bool, fn func(row map[string]string) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("Unable to open GTFS table (%s)", name)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("Malformed GTFS table (%s): %w", name, err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Malformed GTFS table (%s): %w", name, err)
+		}
+
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+			}
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("Invalid GTFS table (%s): %w", name, err)
+		}
+	}
+}
+
+// Check a configuration for mistakes, reporting every one found
+func (s *system) validate() []error {
+	var problems []error
+
+	// Nearly always a deployment mistake, such as the wrong file
+	if len(s.Stops) == 0 && !allowEmpty {
+		problems = append(problems, errors.New("No stations configured; use -allowEmpty if that is intended"))
+	}
+
+	// Station IDs must be unique, or the stop map will quietly
+	// drop all but one of them
+	stations := make(map[string]int)
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		if stop == nil {
+			problems = append(problems, fmt.Errorf("Missing station at stop %d", i))
+			continue
+		}
+
+		if first, ok := stations[idKey(stop.ID)]; ok {
+			problems = append(problems, fmt.Errorf("Duplicate station ID (%s) at stops %d and %d", stop.ID, first, i))
+		} else {
+			stations[idKey(stop.ID)] = i
+		}
+
+		// A mistyped coordinate quietly breaks distances and maps;
+		// (0, 0) is almost always a station someone forgot to fill in
+		if !stop.Coord.valid() {
+			problems = append(problems, fmt.Errorf("Coordinates out of range (%g, %g) for station %s", stop.Coord.Lat, stop.Coord.Lon, stop.ID))
+		} else if stop.Coord == (coordinates{}) && !allowNullIsland {
+			problems = append(problems, fmt.Errorf("Coordinates missing (0, 0) for station %s; use -allowNullIsland if they are right", stop.ID))
+		}
+
+		// Likewise line IDs within a direction, and any direction
+		// with lines needs a name to show
+		for dir, lines := range stop.Lines {
+			if len(lines) > 0 && stop.Directions[dir] == "" {
+				problems = append(problems, fmt.Errorf("Missing name for station %s, direction %d", stop.ID, dir))
+			}
+
+			keys := make([]string, 0, len(lines))
+			for key := range lines {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			ids := make(map[string]string)
+			for _, key := range keys {
+				ln := lines[key]
+				if ln == nil {
+					problems = append(problems, fmt.Errorf("Missing line (%s) for station %s, direction %d", key, stop.ID, dir))
+					continue
+				}
+
+				if first, ok := ids[idKey(ln.ID)]; ok {
+					problems = append(problems, fmt.Errorf("Duplicate line ID (%s) in %s and %s for station %s, direction %d", ln.ID, first, key, stop.ID, dir))
+				} else {
+					ids[idKey(ln.ID)] = key
+				}
+
+				// A bad color quietly renders as none at all; no color
+				// at all is fine
+				if ln.Color != "" && !isValidColor(ln.Color) {
+					problems = append(problems, fmt.Errorf("Invalid color (%s) for station %s, line %s", ln.Color, stop.ID, ln.ID))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// Cache system IDs for future lookup. This must be called whenever
+// Stops changes.
+func (s *system) rebuildStopMap() {
+	// Obtain a writer lock
+	s.Lock()
+	defer s.Unlock()
+
+	s.indexStops()
+}
+
+// Rebuild the stop map for a caller already holding the writer lock
+func (s *system) indexStops() {
+	s.stopMap = make(map[string]*station, len(s.Stops))
+	for i := 0; i < len(s.Stops); i++ {
+		stop := s.Stops[i]
+		s.stopMap[idKey(stop.ID)] = stop
+	}
+}
+
+// Swap a freshly loaded configuration into the system. Live times are
+// carried over for every line whose station and line IDs still match;
+// new lines start out with whatever the configuration supplies.
+func (s *system) replace(fresh *system) {
+	// Obtain a writer lock
+	s.Lock()
+	defer s.Unlock()
+
+	for i := 0; i < len(fresh.Stops); i++ {
+		stop := fresh.Stops[i]
+		old := s.stopMap[idKey(stop.ID)]
+		if old == nil {
+			continue
+		}
+
+		for dir := range stop.Lines {
+			for id, ln := range stop.Lines[dir] {
+				if prev := findLine(old.Lines[dir], id); prev != nil {
+					ln.Times, ln.TimesAbs, ln.absolute, ln.updatedAt = prev.Times, prev.TimesAbs, prev.absolute, prev.updatedAt
+				}
+			}
+		}
+	}
+
+	// Streams following a station that is gone would otherwise wait
+	// for it forever
+	for _, old := range s.Stops {
+		if fresh.stopMap[idKey(old.ID)] == nil {
+			s.disconnect(old)
+		}
+	}
+
+	s.Name = fresh.Name
+	s.Tagline = fresh.Tagline
+	s.Alert = fresh.Alert
+	s.Stops = fresh.Stops
+	s.TimeMax = fresh.TimeMax
+	s.stopMap = fresh.stopMap
+	s.changed()
+	s.loaded = true
+
+	// Deltas can't describe a new configuration
+	s.notify(nil, nil)
+}
@@ -0,0 +1,3645 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Start from the defaults Main's flags would give, without the logging
+func TestMain(m *testing.M) {
+	if err := defineFlags(flag.NewFlagSet("test", flag.ContinueOnError)).apply(); err != nil {
+		panic(err)
+	}
+	staticDirectory = "../../static"
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Two stations sharing the red line, and one with only a single direction
+const testConfig = `{"name":"Test","tagline":"t","timeMax":45,"stops":[
+{"name":"Café Central","id":"cafe","coord":{"lat":37.78,"lon":-122.41},"directions":["N","S"],"lines":[{"red":{"name":"Red","id":"red","color":"#f00"},"blue":{"name":"Blue","id":"blue","color":"#00f"}},{"red":{"name":"Red","id":"red","color":"#f00"}}]},
+{"name":"Civic Center","id":"civic","coord":{"lat":37.779,"lon":-122.414},"directions":["N","S"],"lines":[{"red":{"name":"Red","id":"red","color":"#f00"}},{}]},
+{"name":"Embarcadero","id":"emb","coord":{"lat":37.79,"lon":-122.39},"directions":["In","Out"],"lines":[{"green":{"name":"Green","id":"green","color":"#0f0"}},null]}
+]}`
+
+// A system loaded from testConfig
+func newTestSystem(t testing.TB) *system {
+	t.Helper()
+	s, err := parseConfig(strings.NewReader(testConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.loaded = true
+	return s
+}
+
+// Route the whole server, with s as its only system
+func routeTestSystem(t *testing.T, s *system) {
+	t.Helper()
+	setFlag(t, &mux, http.NewServeMux())
+	setFlag(t, &systems, []*hostedSystem{{source: "test", sys: s}})
+	setupRoutes()
+}
+
+// The whole server, with s as its only system
+func newTestServer(t *testing.T, s *system) *httptest.Server {
+	t.Helper()
+	routeTestSystem(t, s)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Make a request of a test server, failing the test if it can't be made
+func fetch(t *testing.T, srv *httptest.Server, method, path, body string, header ...string) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Set a package variable for the length of a test
+func setFlag[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// Run a request straight through a handler
+func do(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// Decode a JSON response, failing the test if it isn't one
+func decode[T any](t testing.TB, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return v
+}
+
+func TestUpdateRejectsMisspelledFields(t *testing.T) {
+	for _, tc := range []struct {
+		body, want string
+	}{
+		{`{"stops":[{"stationID":"cafe","lines":[{"lineId":"red","index":0,"times":[3]}]}]}`, `"lineId" in update.stops[0].lines[0]; did you mean "lineID"?`},
+		{`{"stops":[{"stationid":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`, `did you mean "stationID"?`},
+		{`{"stops":[{"stationID":"cafe","Lines":[{"lineID":"red","index":0,"times":[3]}]}]}`, `did you mean "lines"?`},
+		{`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","INDEX":1,"times":[3]}]}]}`, `did you mean "index"?`},
+		{`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"tims":[3]}]}]}`, `unknown field "tims"`},
+	} {
+		s := newTestSystem(t)
+		w := do(s.handleUpdate, "POST", "/update", tc.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", tc.body, w.Code)
+			continue
+		}
+		if e := decode[apiError](t, w); !strings.Contains(e.Detail, tc.want) {
+			t.Errorf("%s: detail %q doesn't mention %q", tc.body, e.Detail, tc.want)
+		}
+		if times := s.stopMap["cafe"].Lines[0]["red"].Times; len(times) != 0 {
+			t.Errorf("%s: rejected update applied %v", tc.body, times)
+		}
+	}
+}
+
+func TestUpdateAcceptsExactFields(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3,9]}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if sum := decode[updateSummary](t, w); sum.LinesUpdated != 1 {
+		t.Errorf("linesUpdated = %d, want 1", sum.LinesUpdated)
+	}
+}
+
+func TestUpdateSkipsUnchangedTimes(t *testing.T) {
+	s := newTestSystem(t)
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[9,3]}]}]}`
+	for i, want := range []int{1, 0} {
+		w := do(s.handleUpdate, "POST", "/update", body)
+		if sum := decode[updateSummary](t, w); sum.LinesUpdated != want {
+			t.Errorf("post %d: linesUpdated = %d, want %d", i+1, sum.LinesUpdated, want)
+		}
+	}
+}
+
+func TestUpdateEmptyTimesAbsClearsMinutes(t *testing.T) {
+	s := newTestSystem(t)
+	do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"timesAbs":[]}]}]}`)
+	if sum := decode[updateSummary](t, w); sum.LinesUpdated != 1 {
+		t.Errorf("linesUpdated = %d, want 1", sum.LinesUpdated)
+	}
+	if times := s.stopMap["cafe"].Lines[0]["red"].Times; len(times) != 0 {
+		t.Errorf("times = %v, want none", times)
+	}
+}
+
+// Checks the client library's output against testdata/metrics.txt
+func TestMetricsExposition(t *testing.T) {
+	setFlag(t, &systems, []*hostedSystem{{sys: newTestSystem(t)}})
+	setFlag(t, &mainMetrics, newMetrics())
+	mainMetrics.requests.WithLabelValues("info", "success").Add(3)
+	mainMetrics.requests.WithLabelValues("update", "error").Inc()
+	mainMetrics.requests.WithLabelValues("odd \"name\"\\path\nline", "error").Inc()
+
+	// Durations exact in binary, so the sum is too
+	for _, d := range []float64{0x1p-14, 0x1p-14, 0x1p-8, 1.5 - 0x1p-13 - 0x1p-8} {
+		mainMetrics.updateDuration.Observe(d)
+	}
+	mainMetrics.staleEvents.Add(2)
+	mainMetrics.stale.Set(1)
+
+	want, err := os.ReadFile("testdata/metrics.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if got := w.Body.String(); got != string(want) {
+		t.Errorf("exposition differs from testdata/metrics.txt:\n%s", got)
+	}
+}
+
+// Turn spaced hex, as specifications write bytes, into bytes
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Serve s's /ws through the standard middleware
+func newWebSocketServer(t *testing.T, s *system) *httptest.Server {
+	srv := httptest.NewServer(logRequests(instrument("ws", s.handleWebSocket)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Connect to /ws, sending origin if it isn't empty
+func dialWebSocket(t *testing.T, srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// The next event or reply sent over a WebSocket
+func readWebSocket(t *testing.T, conn *websocket.Conn) map[string]json.RawMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg map[string]json.RawMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	s := newTestSystem(t)
+	conn, _, err := dialWebSocket(t, newWebSocketServer(t, s), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWebSocket(t, conn); string(msg["type"]) != `"snapshot"` {
+		t.Fatalf("got %s first, want a snapshot", msg["type"])
+	}
+
+	// Following one station starts again from its snapshot
+	conn.WriteJSON(map[string]string{"stationID": "nowhere"})
+	if msg := readWebSocket(t, conn); string(msg["error"]) != `"Invalid stop id (nowhere)"` {
+		t.Errorf("unknown station: got %v", msg)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	if msg := readWebSocket(t, conn); string(msg["error"]) != `"Malformed subscribe request"` {
+		t.Errorf("malformed request: got %v", msg)
+	}
+	conn.WriteJSON(map[string]string{"stationID": "cafe"})
+	msg := readWebSocket(t, conn)
+	var stop struct{ ID string }
+	json.Unmarshal(msg["data"], &stop)
+	if string(msg["type"]) != `"snapshot"` || stop.ID != "cafe" {
+		t.Fatalf("after following cafe: got %s for %q, want its snapshot", msg["type"], stop.ID)
+	}
+
+	// Only that station's changes follow
+	for _, u := range []*update{
+		{Stops: []stationUpdate{{StationID: "emb", Lines: []lineUpdate{{LineID: "green", Times: []int{4}}}}}},
+		{Stops: []stationUpdate{{StationID: "cafe", Lines: []lineUpdate{{LineID: "red", Times: []int{3}}}}}},
+	} {
+		if _, err := s.processUpdates(u, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg = readWebSocket(t, conn)
+	json.Unmarshal(msg["data"], &stop)
+	if string(msg["type"]) != `"delta"` || stop.ID != "cafe" {
+		t.Errorf("got %s for %q, want a delta for cafe", msg["type"], stop.ID)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	setFlag(t, &corsOrigins, []string{"https://kiosk.example"})
+	s := newTestSystem(t)
+	srv := newWebSocketServer(t, s)
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{srv.URL, true},
+		{"https://elsewhere.example", false},
+		{"https://kiosk.example", true},
+	} {
+		_, resp, err := dialWebSocket(t, srv, tc.origin)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("origin %q: got %v, want allowed %v", tc.origin, err, tc.ok)
+		}
+		if !tc.ok && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: got %v, want a 403", tc.origin, resp)
+		}
+	}
+}
+
+func TestWebSocketRejectsOrphanContinuation(t *testing.T) {
+	s := newTestSystem(t)
+	conn, _, err := dialWebSocket(t, newWebSocketServer(t, s), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readWebSocket(t, conn)
+
+	// A final, masked continuation of "Hello" (RFC 6455, section 5.7)
+	// with no data frame before it
+	conn.UnderlyingConn().Write(unhex(t, "80 85 37fa213d 7f9f4d5158"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Errorf("got %v, want the connection closed for a protocol error", err)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	s := newTestSystem(t)
+	h := gzipped(s.handleInfo)
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"br, gzip;q=0.5", "gzip"},
+	} {
+		r := httptest.NewRequest("GET", "/info", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if got := w.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", tc.accept, got, tc.want)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Accept-Encoding %q: Content-Type %q", tc.accept, ct)
+		}
+
+		body := io.Reader(w.Body)
+		if tc.want == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		var info system
+		if err := json.NewDecoder(body).Decode(&info); err != nil || len(info.Stops) != 3 {
+			t.Errorf("Accept-Encoding %q: decoding gave %d stations, %v", tc.accept, len(info.Stops), err)
+		}
+	}
+}
+
+func TestGzipLeavesEncodedBodiesAlone(t *testing.T) {
+	h := gzipped(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("already compressed"))
+	})
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if got := w.Header().Get("Content-Encoding"); got != "br" || w.Body.String() != "already compressed" {
+		t.Errorf("got %q encoded %q, want the handler's body as it was", w.Body, got)
+	}
+}
+
+// Logs collected by captureLogs, safe to read while goroutines log
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Collect what is logged for the length of a test
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return buf
+}
+
+func TestGTFSUnmappedIDsWarnedOnce(t *testing.T) {
+	logs := captureLogs(t)
+	m := &gtfsMapping{Stops: map[string]string{"1": "cafe"}, Routes: map[string]string{"R": "red"}}
+	arrivals := []gtfsArrival{{stopID: "2", routeID: "R"}, {stopID: "1", routeID: "X"}}
+	for i := 0; i < 3; i++ {
+		m.update(arrivals, time.Now())
+	}
+
+	warnings := strings.Count(logs.String(), "level=WARN")
+	if warnings != 1 || !strings.Contains(logs.String(), "route X stop 2") {
+		t.Errorf("got %d warnings, want one naming both IDs:\n%s", warnings, logs)
+	}
+
+	// A new ID is still worth a warning
+	m.update([]gtfsArrival{{stopID: "3", routeID: "R"}}, time.Now())
+	if got := strings.Count(logs.String(), "level=WARN"); got != 2 {
+		t.Errorf("got %d warnings after a new ID, want 2", got)
+	}
+}
+
+func TestDecodeTripUpdates(t *testing.T) {
+	stopTime := func(stopID string, arrival, departure int64, rel gtfs.TripUpdate_StopTimeUpdate_ScheduleRelationship) *gtfs.TripUpdate_StopTimeUpdate {
+		st := &gtfs.TripUpdate_StopTimeUpdate{StopId: proto.String(stopID), ScheduleRelationship: rel.Enum()}
+		if arrival != 0 {
+			st.Arrival = &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(arrival)}
+		}
+		if departure != 0 {
+			st.Departure = &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(departure)}
+		}
+		return st
+	}
+	feed, err := proto.Marshal(&gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(1700000000),
+		},
+		Entity: []*gtfs.FeedEntity{
+			{
+				Id: proto.String("t1"),
+				TripUpdate: &gtfs.TripUpdate{
+					Trip: &gtfs.TripDescriptor{TripId: proto.String("T1"), RouteId: proto.String("R"), DirectionId: proto.Uint32(1)},
+					StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{
+						stopTime("S1", 1700000300, 0, gtfs.TripUpdate_StopTimeUpdate_SCHEDULED),
+						stopTime("S2", 0, 1700000600, gtfs.TripUpdate_StopTimeUpdate_SCHEDULED),
+						stopTime("S3", 1700000900, 0, gtfs.TripUpdate_StopTimeUpdate_SKIPPED),
+					},
+				},
+			},
+			{
+				Id: proto.String("a1"),
+				Alert: &gtfs.Alert{HeaderText: &gtfs.TranslatedString{Translation: []*gtfs.TranslatedString_Translation{
+					{Text: proto.String("Elevator out")},
+				}}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivals, err := decodeTripUpdates(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The skipped stop and the alert are left out, and a departure
+	// stands in for a missing arrival
+	want := []gtfsArrival{
+		{stopID: "S1", routeID: "R", direction: 1, time: 1700000300},
+		{stopID: "S2", routeID: "R", direction: 1, time: 1700000600},
+	}
+	if !slices.Equal(arrivals, want) {
+		t.Errorf("got %+v, want %+v", arrivals, want)
+	}
+
+	if _, err := decodeTripUpdates([]byte{0x12, 0x07, 0x74}); err == nil {
+		t.Error("a truncated feed decoded without an error")
+	}
+}
+
+// Use testConfig as the main system for the length of a test
+func useMainSystem(t *testing.T) *system {
+	t.Helper()
+	mainSystem.replace(newTestSystem(t))
+	t.Cleanup(func() {
+		mainSystem.replace(&system{stopMap: make(map[string]*station)})
+		mainSystem.loaded = false
+	})
+	return &mainSystem
+}
+
+func TestGTFSSkipsDepartedArrivals(t *testing.T) {
+	useMainSystem(t)
+	now := time.Unix(1_700_000_000, 0)
+	m := &gtfsMapping{Stops: map[string]string{"1": "cafe"}, Routes: map[string]string{"R": "red"}}
+	u := m.update([]gtfsArrival{
+		{stopID: "1", routeID: "R", direction: 0, time: now.Unix() - 30},
+		{stopID: "1", routeID: "R", direction: 0, time: now.Unix() + 90},
+	}, now)
+
+	// Half a minute ago is gone, not due now
+	if len(u.Stops) != 1 || len(u.Stops[0].Lines) != 2 || !slices.Equal(u.Stops[0].Lines[0].Times, []int{1}) {
+		t.Errorf("got %+v, want only the arrival a minute out", u.Stops)
+	}
+}
+
+func TestMinutesUntil(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		ts   int64
+		want int
+	}{
+		{now.Unix() + 150, 2},
+		{now.Unix() + 60, 1},
+		{now.Unix() + 59, 0},
+		{now.Unix() - 1, -1},
+	} {
+		if got := minutesUntil(tc.ts, now); got != tc.want {
+			t.Errorf("minutesUntil(now%+d) = %d, want %d", tc.ts-now.Unix(), got, tc.want)
+		}
+	}
+}
+
+func TestTimestampMinutesFollowTheClock(t *testing.T) {
+	now := time.Now()
+	ln := &line{TimesAbs: []int64{now.Unix() + 90, now.Unix() + 620}, absolute: true}
+	if times, _ := ln.current(now); !slices.Equal(times, []int{1, 10}) {
+		t.Errorf("now: times = %v, want [1 10]", times)
+	}
+	times, abs := ln.current(now.Add(5 * time.Minute))
+	if !slices.Equal(times, []int{5}) || !slices.Equal(abs, []int64{now.Unix() + 620}) {
+		t.Errorf("5 minutes on: times = %v, timesAbs = %v, want [5] and the later timestamp", times, abs)
+	}
+
+	// 620 seconds out stays 10 minutes for 20 more seconds, before 90
+	// seconds out stops being 1 minute
+	if next := ln.nextTick(now); next != now.Unix()+21 {
+		t.Errorf("nextTick = now%+d, want now+21", next-now.Unix())
+	}
+}
+
+func TestMinuteTimestampsFixedOnUpdate(t *testing.T) {
+	setFlag(t, &reportTimestamps, true)
+	s := newTestSystem(t)
+	before := time.Now().Unix()
+	do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[5]}]}]}`)
+	stored := s.stopMap["cafe"].Lines[0]["red"].TimesAbs
+	if len(stored) != 1 || stored[0] < before+300 || stored[0] > time.Now().Unix()+300 {
+		t.Fatalf("timesAbs = %v, want one about 5 minutes from now", stored)
+	}
+	for i := 0; i < 2; i++ {
+		if got := s.stopMap["cafe"].snapshot().Lines[0]["red"].TimesAbs; !slices.Equal(got, stored) {
+			t.Errorf("snapshot %d: timesAbs = %v, want %v", i+1, got, stored)
+		}
+	}
+}
+
+func TestTickInvalidatesInfo(t *testing.T) {
+	s := newTestSystem(t)
+	do(s.handleUpdate, "POST", "/update", fmt.Sprintf(`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"timesAbs":[%d]}]}]}`, time.Now().Unix()+600))
+	if s.nextTick == 0 {
+		t.Fatal("no tick scheduled for timestamps")
+	}
+
+	version := s.version.Load()
+	s.tick()
+	if s.version.Load() != version {
+		t.Error("tick before a minute changed bumped the version")
+	}
+	s.nextTick = time.Now().Unix() - 1
+	s.tick()
+	if s.version.Load() == version {
+		t.Error("tick after a minute changed left the version")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const d = 100 * time.Millisecond
+	t0 := time.Unix(1_700_000_000, 0)
+	at := func(n int) time.Time { return t0.Add(time.Duration(n) * d) }
+
+	type step struct {
+		t    time.Time
+		want bool
+	}
+	for _, tc := range []struct {
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{10, 1, []step{{at(0), true}, {at(0), false}, {at(1), true}, {at(1), false}, {at(2), true}, {at(2), false}}},
+		{10, 3, []step{
+			{at(0), true}, {at(0), true}, {at(0), true}, {at(0), false},
+			{at(1), true}, {at(1), false},
+			{at(4), true}, {at(4), true}, {at(4), true}, {at(4), false},
+			// The clock stepping back refills nothing
+			{at(3), false}, {at(4), true},
+			// Nor does waiting longer than the burst allows
+			{at(100), true}, {at(100), true}, {at(100), true}, {at(100), false},
+		}},
+	} {
+		l := newRateLimiter(tc.rate, tc.burst)
+		for i, step := range tc.steps {
+			if ok, _ := l.allow("client", step.t); ok != step.want {
+				t.Errorf("rate %g, burst %d, step %d at t%d: allowed %v, want %v", tc.rate, tc.burst, i, step.t.Sub(t0)/d, ok, step.want)
+			}
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	t0 := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter(10, 1)
+	l.allow("a", t0)
+	if _, wait := l.allow("a", t0); wait != 100*time.Millisecond {
+		t.Errorf("wait = %v, want 100ms", wait)
+	}
+	if _, wait := l.allow("a", t0.Add(40*time.Millisecond)); wait != 60*time.Millisecond {
+		t.Errorf("wait 40ms later = %v, want 60ms", wait)
+	}
+	if ok, _ := l.allow("b", t0); !ok {
+		t.Error("a second client shares the first's bucket")
+	}
+}
+
+// Responses are encoded as msgpack from the same structs as the JSON,
+// so every field needs the same name in both
+func TestMsgpackTagsMatchJSON(t *testing.T) {
+	for _, v := range []any{line{}, coordinates{}, lineSnapshot{}, stationSnapshot{}, systemSnapshot{}, lineV1{}, stationV1{}, systemV1{}} {
+		rt := reflect.TypeOf(v)
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if js := f.Tag.Get("json"); js != "" && f.Tag.Get("msgpack") != js {
+				t.Errorf("%s.%s: msgpack tag %q, want %q as for JSON", rt.Name(), f.Name, f.Tag.Get("msgpack"), js)
+			}
+		}
+	}
+}
+
+func TestUpdateIsAllOrNothing(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[
+		{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]},{"lineID":"blue","index":0,"times":[5]}]},
+		{"stationID":"civic","lines":[{"lineID":"purple","index":0,"times":[7]}]}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d, want 400", w.Code)
+	}
+	for _, id := range []string{"red", "blue"} {
+		if ln := s.stopMap["cafe"].Lines[0][id]; len(ln.Times) != 0 || !ln.updatedAt.IsZero() {
+			t.Errorf("%s changed by a rejected batch: %v", id, ln.Times)
+		}
+	}
+}
+
+func TestJSONContentType(t *testing.T) {
+	srv := newTestServer(t, newTestSystem(t))
+	for _, tc := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/info", ""},
+		{"GET", "/stop?id=cafe", ""},
+		{"GET", "/stop?id=nowhere", ""},
+		{"GET", "/stop/next?id=cafe", ""},
+		{"GET", "/stop/batch?ids=cafe,civic", ""},
+		{"GET", "/stop/directions?id=cafe", ""},
+		{"GET", "/nearest?lat=37.78&lon=-122.41", ""},
+		{"GET", "/nearest", ""},
+		{"GET", "/lines", ""},
+		{"GET", "/lines/near?lat=37.78&lon=-122.41&radius=500", ""},
+		{"GET", "/line?id=red", ""},
+		{"GET", "/stops", ""},
+		{"GET", "/stops/bbox?minLat=37&minLon=-123&maxLat=38&maxLon=-122", ""},
+		{"GET", "/search?q=cafe", ""},
+		{"GET", "/stats", ""},
+		{"GET", "/readyz", ""},
+		{"GET", "/version", ""},
+		{"POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`},
+		{"POST", "/update", `{"stops":[{"stationID":"nowhere","lines":[]}]}`},
+		{"POST", "/update", `{"stops":`},
+	} {
+		resp := fetch(t, srv, tc.method, tc.path, tc.body)
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s %s (%d): Content-Type %q", tc.method, tc.path, resp.StatusCode, ct)
+		}
+	}
+}
+
+func TestUpdateSummary(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[
+		{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]},{"lineID":"red","index":1,"times":[4]}]},
+		{"stationID":"emb","lines":[{"lineID":"green","index":0,"times":[5]}]}]}`)
+	sum := decode[updateSummary](t, w)
+	if w.Code != http.StatusOK || sum.StationsUpdated != 2 || sum.LinesUpdated != 3 || sum.DryRun || len(sum.Errors) != 0 {
+		t.Errorf("got %d %s, want 2 stations and 3 lines updated", w.Code, w.Body)
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	s := newTestSystem(t)
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+	for _, tc := range []struct {
+		name, key string
+		want      int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "guess", http.StatusUnauthorized},
+		{"correct", "sekrit", http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		s.handleUpdate(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s key: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if applied := len(s.stopMap["cafe"].Lines[0]["red"].Times) > 0; applied != (tc.want == http.StatusOK) {
+			t.Errorf("%s key: applied = %v", tc.name, applied)
+		}
+	}
+}
+
+func TestRebuildStopMap(t *testing.T) {
+	s := newTestSystem(t)
+	s.Stops = []*station{s.Stops[2], {ID: "pier", Name: "Pier 39"}, s.Stops[0]}
+	s.rebuildStopMap()
+
+	if len(s.stopMap) != len(s.Stops) {
+		t.Errorf("got %d stations mapped, want %d", len(s.stopMap), len(s.Stops))
+	}
+	for i, stop := range s.Stops {
+		if s.stopMap[stop.ID] != s.Stops[i] {
+			t.Errorf("%s doesn't map to Stops[%d]", stop.ID, i)
+		}
+	}
+	if s.stopMap["civic"] != nil {
+		t.Error("civic is still mapped after being removed from Stops")
+	}
+}
+
+func TestStopsOmitLines(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleStops, "GET", "/stops", "")
+	stops := decode[[]map[string]any](t, w)
+	if len(stops) != len(s.Stops) {
+		t.Fatalf("got %d stations, want %d", len(stops), len(s.Stops))
+	}
+	for _, stop := range stops {
+		if _, ok := stop["lines"]; ok {
+			t.Errorf("%v has lines", stop["id"])
+		}
+		if stop["id"] == nil || stop["name"] == nil || stop["coord"] == nil {
+			t.Errorf("%v is missing its id, name or coordinates", stop)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestSystem(t)
+	for _, tc := range []struct {
+		q    string
+		want []string
+	}{
+		{"cafe", []string{"cafe"}},
+		{"CAFÉ", []string{"cafe"}},
+		{"cEnTr", []string{"cafe", "civic"}},
+		{"Civic", []string{"civic"}},
+		{"cnter", []string{"civic"}},
+		{"embarcadro", []string{"emb"}},
+		{"zzz", []string{}},
+	} {
+		w := do(s.handleSearch, "GET", "/search?q="+url.QueryEscape(tc.q), "")
+		var ids []string
+		for _, result := range decode[[]searchResult](t, w) {
+			ids = append(ids, result.ID)
+		}
+		if !slices.Equal(ids, tc.want) {
+			t.Errorf("q=%s: got %v, want %v", tc.q, ids, tc.want)
+		}
+	}
+
+	for _, target := range []string{"/search", "/search?q=", "/search?q=%20"} {
+		if w := do(s.handleSearch, "GET", target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestLogRequestsStatus(t *testing.T) {
+	s := newTestSystem(t)
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{"/stop?id=nowhere", "status=400"},
+		{"/stop?id=cafe", "status=200"}, // Never calls WriteHeader
+	} {
+		logs := captureLogs(t)
+		do(logRequests(s.handleStopInfo), "GET", tc.target, "")
+		if !strings.Contains(logs.String(), "msg=Request method=GET url=\""+tc.target+"\"") || !strings.Contains(logs.String(), tc.want) {
+			t.Errorf("%s: want a request logged with %s, got:\n%s", tc.target, tc.want, logs)
+		}
+	}
+}
+
+func TestInfoETag(t *testing.T) {
+	s := newTestSystem(t)
+	first := do(s.handleInfo, "GET", "/info", "")
+	tag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || tag == "" {
+		t.Fatalf("got %d with ETag %q, want 200 with one", first.Code, tag)
+	}
+
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set("If-None-Match", tag)
+	w := httptest.NewRecorder()
+	s.handleInfo(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+
+	// An update makes the tag stale
+	do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`)
+	w = httptest.NewRecorder()
+	s.handleInfo(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == tag {
+		t.Errorf("after an update, got %d with ETag %s, want 200 with a new one", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestCountdown(t *testing.T) {
+	s := newTestSystem(t)
+	red := s.stopMap["cafe"].Lines[0]["red"]
+	red.Times = []int{1, 3, 5}
+	blue := s.stopMap["cafe"].Lines[0]["blue"]
+	version := s.version.Load()
+
+	s.countdown()
+	if !slices.Equal(red.Times, []int{2, 4}) {
+		t.Errorf("after one minute got %v, want [2 4]", red.Times)
+	}
+	if len(blue.Times) != 0 {
+		t.Errorf("a line without times got %v", blue.Times)
+	}
+	if s.version.Load() == version {
+		t.Error("counting down didn't change the version")
+	}
+
+	for i := 0; i < 4; i++ {
+		s.countdown()
+	}
+	if len(red.Times) != 0 {
+		t.Errorf("after five minutes got %v, want none", red.Times)
+	}
+}
+
+// An update of a single line's times
+func lineTimes(stationID, lineID string, index int, times ...int) *update {
+	return &update{Stops: []stationUpdate{{StationID: stationID, Lines: []lineUpdate{{LineID: lineID, Index: index, Times: times}}}}}
+}
+
+func TestUpdateTimeMax(t *testing.T) {
+	s := newTestSystem(t)
+	red := s.stopMap["cafe"].Lines[0]["red"]
+
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3, 45), false); err != nil {
+		t.Errorf("exactly TimeMax: %v", err)
+	}
+	if !slices.Equal(red.Times, []int{3, 45}) {
+		t.Errorf("got %v, want [3 45]", red.Times)
+	}
+
+	_, err := s.processUpdates(lineTimes("cafe", "red", 0, 5, 46), false)
+	if err == nil || !strings.Contains(err.Error(), "Time out of range (46) for station cafe, line red") {
+		t.Errorf("over TimeMax: got %v", err)
+	}
+	if !slices.Equal(red.Times, []int{3, 45}) {
+		t.Errorf("a rejected update changed the times to %v", red.Times)
+	}
+
+	// Vehicles that have already left are dropped rather than rejected
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, -2, 7), false); err != nil {
+		t.Errorf("negative: %v", err)
+	}
+	if !slices.Equal(red.Times, []int{7}) {
+		t.Errorf("got %v, want [7]", red.Times)
+	}
+
+	// No cap at all without a TimeMax
+	s.TimeMax = 0
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 500), false); err != nil {
+		t.Errorf("TimeMax 0: %v", err)
+	}
+}
+
+func TestUpdateNegativeIndex(t *testing.T) {
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	resp := fetch(t, srv, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":-1,"times":[3]}]}]}`, "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d, want 400", resp.StatusCode)
+	}
+
+	// The server is still up
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/info afterwards: got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateSortsTimes(t *testing.T) {
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 7, 2, 11), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Times; !slices.Equal(got, []int{2, 7, 11}) {
+		t.Errorf("got %v, want [2 7 11]", got)
+	}
+}
+
+func TestUpdateMaxTimes(t *testing.T) {
+	setFlag(t, &maxTimes, 3)
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 1, 2, 3), false); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+
+	_, err := s.processUpdates(lineTimes("cafe", "red", 0, 1, 2, 3, 4), false)
+	if err == nil || !strings.Contains(err.Error(), "Too many times (4, max 3)") {
+		t.Errorf("over the limit: got %v", err)
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Times; !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("a rejected update changed the times to %v", got)
+	}
+}
+
+func TestConfigDuplicateIDs(t *testing.T) {
+	_, err := parseConfig(strings.NewReader(`{"stops":[
+		{"id":"a","coord":{"lat":1,"lon":1},"directions":["N","S"],"lines":[{"x":{"id":"red"},"y":{"id":"red"}},{}]},
+		{"id":"b","coord":{"lat":1,"lon":1}},
+		{"id":"a","coord":{"lat":1,"lon":1}}]}`), "dup.json")
+	if err == nil {
+		t.Fatal("duplicate IDs were accepted")
+	}
+	for _, want := range []string{
+		"Invalid configuration (dup.json)",
+		"Duplicate station ID (a) at stops 0 and 2",
+		"Duplicate line ID (red) in x and y for station a, direction 0",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't mention %q", err, want)
+		}
+	}
+
+	if _, err := parseConfig(strings.NewReader(testConfig), "test"); err != nil {
+		t.Errorf("a line ID shared across stations and directions was rejected: %v", err)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	origin := "https://kiosk.example"
+
+	// Off by default
+	srv := newTestServer(t, newTestSystem(t))
+	resp := fetch(t, srv, "GET", "/info", "", "Origin", origin)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("without -corsOrigins got Allow-Origin %q", got)
+	}
+
+	setFlag(t, &corsOrigins, []string{"https://other.example", origin})
+	srv = newTestServer(t, newTestSystem(t))
+	resp = fetch(t, srv, "GET", "/info", "", "Origin", origin)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != origin {
+		t.Errorf("simple GET: got %d with Allow-Origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	resp = fetch(t, srv, "GET", "/info", "", "Origin", "https://evil.example")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("another origin got Allow-Origin %q", got)
+	}
+
+	resp = fetch(t, srv, "OPTIONS", "/update", "", "Origin", origin, "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "content-type, x-api-key")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != origin {
+		t.Errorf("preflight: got %d with Allow-Origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	methods, headers := resp.Header.Get("Access-Control-Allow-Methods"), resp.Header.Get("Access-Control-Allow-Headers")
+	if !strings.Contains(methods, "POST") || !strings.Contains(headers, "Content-Type") || !strings.Contains(headers, "X-API-Key") {
+		t.Errorf("preflight allows methods %q and headers %q", methods, headers)
+	}
+}
+
+func TestUpdateTooLarge(t *testing.T) {
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+	setFlag(t, &maxBody, int64(len(body)-1))
+	s := newTestSystem(t)
+	logs := captureLogs(t)
+
+	w := do(s.handleUpdate, "POST", "/update", body)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d, want 413", w.Code)
+	}
+	if !strings.Contains(logs.String(), "Oversized update") || strings.Contains(logs.String(), "Malformed update") {
+		t.Errorf("want the update logged as oversized, not malformed:\n%s", logs)
+	}
+
+	maxBody++
+	if w := do(s.handleUpdate, "POST", "/update", body); w.Code != http.StatusOK {
+		t.Errorf("at the limit: got %d %s", w.Code, w.Body)
+	}
+}
+
+// A system of n stations, each with a red line one way and a blue line
+// the other
+func benchSystem(b *testing.B, n int) *system {
+	b.Helper()
+	s := &system{Name: "Bench", TimeMax: 45, loaded: true}
+	for i := 0; i < n; i++ {
+		s.Stops = append(s.Stops, &station{
+			ID:         fmt.Sprintf("s%d", i),
+			Name:       fmt.Sprintf("Station %d", i),
+			Coord:      coordinates{37.7 + float64(i)/1000, -122.4},
+			Directions: [2]string{"N", "S"},
+			Lines: [2]map[string]*line{
+				{"red": {Name: "Red", ID: "red", Color: "#f00", Times: []int{}}},
+				{"blue": {Name: "Blue", ID: "blue", Color: "#00f", Times: []int{}}},
+			},
+		})
+	}
+	s.rebuildStopMap()
+	return s
+}
+
+// Feeders updating single stations while displays read others. The
+// systemLock case also holds one lock across every request, as the
+// server did before stations had their own locks, for comparison.
+func BenchmarkUpdateAndRead(b *testing.B) {
+	const stations = 50
+	for _, bc := range []struct {
+		name   string
+		global bool
+	}{
+		{"systemLock", true},
+		{"stationLocks", false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := benchSystem(b, stations)
+			var global sync.RWMutex
+			var workers atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(workers.Add(1)) * 7
+				for pb.Next() {
+					i++
+					id := fmt.Sprintf("s%d", i%stations)
+
+					// One request in four is an update
+					if i%4 == 0 {
+						u := lineTimes(id, "red", 0, i%30+1, i%30+5)
+						if bc.global {
+							global.Lock()
+						}
+						if _, err := s.processUpdates(u, false); err != nil {
+							b.Error(err)
+						}
+						if bc.global {
+							global.Unlock()
+						}
+						continue
+					}
+
+					w := httptest.NewRecorder()
+					r := httptest.NewRequest("GET", "/stop?id="+id, nil)
+					if bc.global {
+						global.RLock()
+					}
+					s.handleStopInfo(w, r)
+					if bc.global {
+						global.RUnlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+// /info served from the cached body, against encoding it afresh for
+// every request as happens when each one follows a change
+func BenchmarkInfo(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		changed bool
+	}{
+		{"cached", false},
+		{"encoded", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := benchSystem(b, 50)
+			for _, stop := range s.Stops {
+				s.processUpdates(lineTimes(stop.ID, "red", 0, 2, 9, 17), false)
+			}
+			r := httptest.NewRequest("GET", "/info", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bc.changed {
+					s.changed()
+				}
+				w := httptest.NewRecorder()
+				s.handleInfo(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestStopNext(t *testing.T) {
+	s := newTestSystem(t)
+	s.stopMap["cafe"].Lines[0]["red"].Times = []int{9, 4, 6}
+	w := do(s.handleStopNext, "GET", "/stop/next?id=cafe", "")
+	next := decode[struct {
+		Lines [2]map[string]struct {
+			Times    []int `json:"times"`
+			Next     *int  `json:"next"`
+			Arrivals []int `json:"arrivals"`
+		} `json:"lines"`
+	}](t, w)
+
+	red := next.Lines[0]["red"]
+	if red.Next == nil || *red.Next != slices.Min(red.Times) || !slices.Equal(red.Arrivals, []int{4, 6, 9}) {
+		t.Errorf("red: got next %v and arrivals %v for times %v", red.Next, red.Arrivals, red.Times)
+	}
+	if blue := next.Lines[0]["blue"]; blue.Next != nil || blue.Arrivals == nil || len(blue.Arrivals) != 0 {
+		t.Errorf("blue: got next %v and arrivals %v, want null and []", blue.Next, blue.Arrivals)
+	}
+}
+
+func TestDirectionFilter(t *testing.T) {
+	s := newTestSystem(t)
+	type stop struct {
+		ID    string                       `json:"id"`
+		Lines [2]map[string]map[string]any `json:"lines"`
+	}
+
+	info := decode[struct{ Stops []stop }](t, do(s.handleInfo, "GET", "/info?dir=1", ""))
+	for _, st := range info.Stops {
+		if len(st.Lines[0]) != 0 {
+			t.Errorf("%s: /info?dir=1 has direction 0 lines %v", st.ID, st.Lines[0])
+		}
+	}
+	if cafe := info.Stops[0]; len(cafe.Lines[1]) != 1 {
+		t.Errorf("cafe: got %v for direction 1, want its red line", cafe.Lines[1])
+	}
+
+	cafe := decode[stop](t, do(s.handleStopInfo, "GET", "/stop?id=cafe&dir=0", ""))
+	if len(cafe.Lines[1]) != 0 || len(cafe.Lines[0]) != 2 {
+		t.Errorf("/stop?dir=0 got lines %v", cafe.Lines)
+	}
+
+	for _, target := range []string{"/info?dir=2", "/info?dir=-1", "/stop?id=cafe&dir=x"} {
+		h := s.handleInfo
+		if strings.HasPrefix(target, "/stop") {
+			h = s.handleStopInfo
+		}
+		if w := do(h, "GET", target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestLoadGTFS(t *testing.T) {
+	// The same feed as a zip file
+	zipped := filepath.Join(t.TempDir(), "gtfs.zip")
+	f, err := os.Create(zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	if err := zw.AddFS(os.DirFS("testdata/gtfs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, path := range []string{"testdata/gtfs", zipped} {
+		s, err := loadGTFS(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		if s.Name != "Muni Test" {
+			t.Errorf("%s: got name %q", path, s.Name)
+		}
+		var ids []string
+		for _, stop := range s.Stops {
+			ids = append(ids, stop.ID)
+		}
+		if !slices.Equal(ids, []string{"POW", "CIV"}) {
+			t.Fatalf("%s: got stops %v, want the station left out", path, ids)
+		}
+
+		civic := s.stopMap["CIV"]
+		if civic.Name != "Civic Center" || civic.Coord != (coordinates{37.7796, -122.4138}) {
+			t.Errorf("%s: got %s at %v", path, civic.Name, civic.Coord)
+		}
+		if civic.Directions != [2]string{"Fisherman's Wharf", "Balboa Park"} {
+			t.Errorf("%s: got directions %q", path, civic.Directions)
+		}
+		if f := civic.Lines[0]["F"]; f == nil || f.Name != "F" || f.Color != "#F0E68C" || f.Destination != "Fisherman's Wharf" {
+			t.Errorf("%s: got F line %+v", path, f)
+		}
+		if j := civic.Lines[1]["J"]; j == nil || j.Name != "Church" || j.Destination != "Balboa Park" {
+			t.Errorf("%s: got J line %+v", path, j)
+		}
+		if f := civic.Lines[1]["F"]; f == nil || f.Destination != "Castro" {
+			t.Errorf("%s: got F line %+v the other way", path, f)
+		}
+		if powell := s.stopMap["POW"]; len(powell.Lines[0]) != 1 || len(powell.Lines[1]) != 1 || powell.Lines[0]["J"] != nil {
+			t.Errorf("%s: got Powell lines %v", path, powell.Lines)
+		}
+	}
+
+	if _, err := loadGTFS("testdata/nothing"); err == nil {
+		t.Error("a missing feed was accepted")
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleExport, "GET", "/export", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := make(map[string][][]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tables[f.Name], err = csv.NewReader(rc).ReadAll(); err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		rc.Close()
+	}
+
+	cafe := []string{"cafe", "Café Central", "37.78", "-122.41"}
+	stops := tables["stops.csv"]
+	if len(stops) != 4 || !slices.ContainsFunc(stops, func(row []string) bool { return slices.Equal(row, cafe) }) {
+		t.Errorf("stops.csv lacks %q: %q", cafe, stops)
+	}
+	want := [][]string{{"route_id", "route_short_name", "route_color"}, {"blue", "Blue", "00f"}, {"green", "Green", "0f0"}, {"red", "Red", "f00"}}
+	if routes := tables["routes.csv"]; !reflect.DeepEqual(routes, want) {
+		t.Errorf("got routes.csv %q, want %q", routes, want)
+	}
+}
+
+func TestWebhookForwardsUpdates(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	type delivery struct {
+		key  string
+		body []byte
+	}
+	deliveries := make(chan delivery, 4)
+	var calls atomic.Int64
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Get("X-API-Key"), body}
+
+		// The first attempt fails, so the webhook has to retry
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer downstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newWebhook(downstream.URL)
+	setFlag(t, &webhooks, []*webhook{h})
+	go h.run(ctx)
+
+	u := lineTimes("cafe", "red", 0, 3, 8)
+	forward(u)
+	want, _ := json.Marshal(u)
+	for attempt := 1; attempt <= 2; attempt++ {
+		select {
+		case d := <-deliveries:
+			if d.key != "sekrit" || !bytes.Equal(d.body, want) {
+				t.Errorf("attempt %d: got %s with key %q, want %s", attempt, d.body, d.key, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d never arrived", attempt)
+		}
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("got another delivery after success: %s", d.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUpdateFileForwarded(t *testing.T) {
+	useMainSystem(t)
+	deliveries := make(chan []byte, 4)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- body
+	}))
+	defer downstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newWebhook(downstream.URL)
+	setFlag(t, &webhooks, []*webhook{h})
+	go h.run(ctx)
+
+	filename := filepath.Join(t.TempDir(), "update.json")
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3,8]}]}]}`
+	if err := os.WriteFile(filename, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyUpdateFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	var got update
+	select {
+	case d := <-deliveries:
+		json.Unmarshal(d, &got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update was never forwarded")
+	}
+	if len(got.Stops) != 1 || got.Stops[0].StationID != "cafe" || !slices.Equal(got.Stops[0].Lines[0].Times, []int{3, 8}) {
+		t.Errorf("got %+v, want the file's update", got)
+	}
+
+	// Applying it again changes nothing, so nothing is passed on
+	if err := applyUpdateFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("got an unchanged update forwarded: %s", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStopsBBox(t *testing.T) {
+	s := newTestSystem(t)
+	s.Stops = append(s.Stops, &station{ID: "fiji", Name: "Suva", Coord: coordinates{-18.1, 178.4}})
+	s.rebuildStopMap()
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"minLat=37.77&minLon=-122.42&maxLat=37.785&maxLon=-122.40", []string{"cafe", "civic"}},
+		{"minLat=37&minLon=-123&maxLat=38&maxLon=-122", []string{"cafe", "civic", "emb"}},
+		{"minLat=0&minLon=0&maxLat=1&maxLon=1", []string{}},
+		{"minLat=-20&minLon=170&maxLat=0&maxLon=-170", []string{"fiji"}}, // Across the antimeridian
+	} {
+		w := do(s.handleStopsBBox, "GET", "/stops/bbox?"+tc.query, "")
+		ids := []string{}
+		for _, stop := range decode[[]stationSummary](t, w) {
+			ids = append(ids, stop.ID)
+		}
+		if !slices.Equal(ids, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, ids, tc.want)
+		}
+	}
+
+	for _, query := range []string{"", "minLat=38&minLon=-123&maxLat=37&maxLon=-122", "minLat=37&minLon=-123&maxLat=91&maxLon=-122", "minLat=x&minLon=-123&maxLat=38&maxLon=-122"} {
+		if w := do(s.handleStopsBBox, "GET", "/stops/bbox?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s := newTestSystem(t)
+	s.lastUpdate.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+
+	// Without -staleThreshold, however old the last update
+	if w := do(s.handleReadyz, "GET", "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("disabled: got %d, want 200: %s", w.Code, w.Body)
+	}
+
+	setFlag(t, &staleThreshold, time.Minute)
+	w := do(s.handleReadyz, "GET", "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("stale: got %d, want 503", w.Code)
+	}
+	got := decode[readiness](t, w)
+	if got.Ready || !got.ConfigLoaded || got.LastUpdate == nil || got.LastUpdateAge == nil || *got.LastUpdateAge < 2*60*60 {
+		t.Errorf("stale: got %s", w.Body)
+	}
+
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3), false); err != nil {
+		t.Fatal(err)
+	}
+	w = do(s.handleReadyz, "GET", "/readyz", "")
+	if got := decode[readiness](t, w); w.Code != http.StatusOK || !got.Ready {
+		t.Errorf("after an update: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	w := do(handleVersion, "GET", "/version", "")
+	got := decode[map[string]any](t, w)
+	want := map[string]any{"version": "dev", "commit": "none", "buildDate": "unknown"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	setFlag(t, &version, "1.2.0")
+	if got := decode[buildInfo](t, do(handleVersion, "GET", "/version", "")); got.Version != "1.2.0" {
+		t.Errorf("got version %q after setting it", got.Version)
+	}
+}
+
+func TestStaticAssets(t *testing.T) {
+	srv := newTestServer(t, newTestSystem(t))
+	want, err := os.ReadFile("../../static/update.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := fetch(t, srv, "GET", "/static/update.html", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, want) {
+		t.Errorf("update.html: got %d with %d bytes, want 200 with %d", resp.StatusCode, len(body), len(want))
+	}
+
+	for _, path := range []string{"/static/missing.css", "/static/", "/static/../ltdiy.go"} {
+		if resp := fetch(t, srv, "GET", path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, resp.StatusCode)
+		}
+	}
+
+	// The API routes are still there
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/info: got %d", resp.StatusCode)
+	}
+}
+
+func TestLineUpdatedAt(t *testing.T) {
+	s := newTestSystem(t)
+	updatedAt := func() *time.Time {
+		t.Helper()
+		stop := decode[stationSnapshot](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", ""))
+		return stop.Lines[0]["red"].UpdatedAt
+	}
+	if got := updatedAt(); got != nil {
+		t.Errorf("before any update got %v", got)
+	}
+
+	before := time.Now()
+	s.processUpdates(lineTimes("cafe", "red", 0, 3), false)
+	first := updatedAt()
+	if first == nil || first.Before(before.Truncate(time.Second)) {
+		t.Fatalf("after an update got %v, want at least %v", first, before)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	s.processUpdates(lineTimes("cafe", "red", 0, 5), false)
+	if second := updatedAt(); second == nil || !second.After(*first) {
+		t.Errorf("after another update got %v, want later than %v", second, first)
+	}
+	if other := s.stopMap["cafe"].Lines[0]["blue"].updatedAt; !other.IsZero() {
+		t.Errorf("a line that wasn't updated got %v", other)
+	}
+}
+
+func TestUpdateDryRun(t *testing.T) {
+	s := newTestSystem(t)
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]},{"lineID":"blue","index":0,"times":[4]}]}]}`
+	version := s.version.Load()
+	for _, tc := range []struct {
+		target, header string
+	}{
+		{"/update?dryRun=true", ""},
+		{"/update", "true"},
+	} {
+		r := httptest.NewRequest("POST", tc.target, strings.NewReader(body))
+		if tc.header != "" {
+			r.Header.Set("X-Dry-Run", tc.header)
+		}
+		w := httptest.NewRecorder()
+		s.handleUpdate(w, r)
+
+		sum := decode[updateSummary](t, w)
+		if w.Code != http.StatusOK || !sum.DryRun || sum.StationsUpdated != 1 || sum.LinesUpdated != 2 {
+			t.Errorf("%s: got %d %s, want the would-be counts", tc.target, w.Code, w.Body)
+		}
+		if red := s.stopMap["cafe"].Lines[0]["red"]; len(red.Times) != 0 || !red.updatedAt.IsZero() {
+			t.Errorf("%s: a dry run changed the times to %v", tc.target, red.Times)
+		}
+		if s.version.Load() != version {
+			t.Errorf("%s: a dry run changed the version", tc.target)
+		}
+	}
+
+	// Problems are still reported
+	w := do(s.handleUpdate, "POST", "/update?dryRun=true", `{"stops":[{"stationID":"nowhere","lines":[]}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid dry run: got %d, want 400", w.Code)
+	}
+}
+
+func TestUpdateReportsEveryError(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[
+		{"stationID":"nowhere","lines":[{"lineID":"red","index":0,"times":[3]}]},
+		{"stationID":"cafe","lines":[{"lineID":"purple","index":0,"times":[3]},{"lineID":"red","index":5,"times":[3]},{"lineID":"blue","index":0,"times":[99]}]}]}`)
+	errs := decode[updateErrors](t, w)
+	want := []string{
+		"Invalid station ID (nowhere)",
+		"Invalid line ID (purple) for station cafe, index 0",
+		"Line index out of bounds (5) for station cafe, line red",
+		"Time out of range (99) for station cafe, line blue",
+	}
+	if w.Code != http.StatusBadRequest || !slices.Equal(errs.Errors, want) {
+		t.Errorf("got %d %q, want %q", w.Code, errs.Errors, want)
+	}
+
+	// A limited number, however bad the batch
+	var u update
+	for i := 0; i < maxUpdateErrors+10; i++ {
+		u.Stops = append(u.Stops, stationUpdate{StationID: fmt.Sprint("nowhere", i)})
+	}
+	body, _ := json.Marshal(u)
+	w = do(s.handleUpdate, "POST", "/update", string(body))
+	if errs := decode[updateErrors](t, w); len(errs.Errors) != maxUpdateErrors {
+		t.Errorf("got %d errors, want %d", len(errs.Errors), maxUpdateErrors)
+	}
+}
+
+func TestUpdateRateLimited(t *testing.T) {
+	setFlag(t, &updateLimiter, newRateLimiter(0.5, 2))
+	srv := newTestServer(t, newTestSystem(t))
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := fetch(t, srv, "POST", "/update", body, "Content-Type", "application/json")
+		if resp.StatusCode != want {
+			t.Errorf("update %d: got %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("got Retry-After %q, want 2", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// Reads aren't limited
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/info: got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateInvalidIndex(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":2,"times":[3]}]}]}`)
+	errs := decode[updateErrors](t, w)
+	if w.Code != http.StatusBadRequest || len(errs.Errors) != 1 || errs.Errors[0] != "Line index out of bounds (2) for station cafe, line red" {
+		t.Errorf("got %d %v, want the index reported", w.Code, errs.Errors)
+	}
+}
+
+func TestLineColor(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleLineColor, "PATCH", "/line/color", `{"lineID":"red","index":0,"color":"#c00"}`)
+	if sum := decode[updateSummary](t, w); w.Code != http.StatusOK || sum.StationsUpdated != 2 || sum.LinesUpdated != 2 {
+		t.Fatalf("got %d %s, want red recolored at two stations", w.Code, w.Body)
+	}
+
+	stop := decode[station](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", ""))
+	if got := stop.Lines[0]["red"].Color; got != "#c00" {
+		t.Errorf("index 0 color = %q, want #c00", got)
+	}
+	if got := stop.Lines[1]["red"].Color; got != "#f00" {
+		t.Errorf("index 1 color = %q, want it left #f00", got)
+	}
+}
+
+func TestLineColorRejectsEmpty(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleLineColor, "PATCH", "/line/color", `{"lineID":"red","index":0,"color":""}`)
+	if e := decode[apiError](t, w); w.Code != http.StatusBadRequest || e.Error != "Invalid color ()" {
+		t.Errorf("got %d %q, want Invalid color", w.Code, e.Error)
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Color; got != "#f00" {
+		t.Errorf("color = %q, want it left #f00", got)
+	}
+}
+
+func TestLineColorInvalidIndex(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleLineColor, "PATCH", "/line/color", `{"lineID":"red","index":5,"color":"#c00"}`)
+	if e := decode[apiError](t, w); w.Code != http.StatusBadRequest || !strings.HasPrefix(e.Error, "Invalid index (5)") {
+		t.Errorf("got %d %q, want Invalid index", w.Code, e.Error)
+	}
+}
+
+// A CORS preflight for method from an allowed origin
+func preflight(t *testing.T, method string) http.Header {
+	t.Helper()
+	setFlag(t, &corsOrigins, []string{"*"})
+	r := httptest.NewRequest("OPTIONS", "/update", nil)
+	r.Header.Set("Origin", "https://kiosk.example")
+	r.Header.Set("Access-Control-Request-Method", method)
+	w := httptest.NewRecorder()
+	cors(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight got %d, want 204", w.Code)
+	}
+	return w.Header()
+}
+
+func TestCORSRequestID(t *testing.T) {
+	if allowed := preflight(t, "POST").Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "X-Request-ID") {
+		t.Errorf("Allow-Headers %q lacks X-Request-ID", allowed)
+	}
+
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set("Origin", "https://kiosk.example")
+	w := httptest.NewRecorder()
+	logRequests(cors(func(w http.ResponseWriter, r *http.Request) {}))(w, r)
+	if exposed := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "X-Request-ID") {
+		t.Errorf("Expose-Headers %q lacks X-Request-ID", exposed)
+	}
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("no X-Request-ID on the response")
+	}
+}
+
+func TestCORSAllowsDelete(t *testing.T) {
+	if allowed := preflight(t, "DELETE").Get("Access-Control-Allow-Methods"); !strings.Contains(allowed, "DELETE") {
+		t.Errorf("Allow-Methods %q lacks DELETE", allowed)
+	}
+}
+
+func TestCORSIdempotencyKey(t *testing.T) {
+	if allowed := preflight(t, "POST").Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "Idempotency-Key") {
+		t.Errorf("Allow-Headers %q lacks Idempotency-Key", allowed)
+	}
+}
+
+func TestStatsLeavesOutHiddenStations(t *testing.T) {
+	setFlag(t, &hideOutOfService, true)
+	s := newTestSystem(t)
+	s.stopMap["emb"].OutOfService = true
+	stats := decode[systemStats](t, do(s.handleStats, "GET", "/stats", ""))
+	if stats.Stations != 2 || stats.Lines != 2 {
+		t.Errorf("stations = %d, lines = %d, want 2 and 2 without Embarcadero", stats.Stations, stats.Lines)
+	}
+}
+
+// Send the audit log to a temporary file, returning a reader of its entries
+func tempAuditLog(t *testing.T) func() []auditEntry {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	setFlag(t, &auditLog, f)
+
+	return func() []auditEntry {
+		t.Helper()
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []auditEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var e auditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("audit line %q: %v", line, err)
+			}
+			entries = append(entries, e)
+		}
+		return entries
+	}
+}
+
+func TestAuditCoalescedUpdates(t *testing.T) {
+	entries := tempAuditLog(t)
+	setFlag(t, &coalesceWindow, time.Hour)
+	s := newTestSystem(t)
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[4]}]}]}`)
+	if sum := decode[updateSummary](t, w); !sum.Queued {
+		t.Fatalf("update wasn't queued: %s", w.Body)
+	}
+
+	// Cancelled straight away, the coalescer just flushes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.coalesce(ctx, time.Hour)
+
+	got := entries()
+	if len(got) != 2 || got[0].Event != "queued" || got[1].Event != "applied" {
+		t.Fatalf("entries = %+v, want queued then applied", got)
+	}
+	if got[0].RemoteAddr == "" || got[1].RemoteAddr != "" {
+		t.Errorf("remote addresses %q and %q, want only the queued one", got[0].RemoteAddr, got[1].RemoteAddr)
+	}
+	want := changedLine{StationID: "cafe", LineID: "red", Index: 0}
+	for _, e := range got {
+		if !slices.Equal(e.Lines, []changedLine{want}) {
+			t.Errorf("%s lines = %+v, want %+v", e.Event, e.Lines, want)
+		}
+	}
+}
+
+// Whether a subscriber's events have been closed, once those queued
+// are read
+func closed(sub *subscriber) bool {
+	for {
+		select {
+		case _, ok := <-sub.events:
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func TestReloadClosesStreamsOfRemovedStations(t *testing.T) {
+	s := newTestSystem(t)
+	gone, kept, all := s.subscribe("emb"), s.subscribe("cafe"), s.subscribe("")
+
+	fresh, err := parseConfig(strings.NewReader(strings.Replace(testConfig, `"id":"emb"`, `"id":"pier"`, 1)), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.replace(fresh)
+
+	if !closed(gone) {
+		t.Error("stream following a removed station left open")
+	}
+	if closed(kept) || closed(all) {
+		t.Error("stream following a remaining station, or everything, closed")
+	}
+}
+
+func TestValidateRejectsNonFiniteCoordinates(t *testing.T) {
+	for _, c := range []coordinates{{math.NaN(), -122.41}, {37.78, math.NaN()}, {math.Inf(1), 0}, {0, math.Inf(-1)}, {91, 0}} {
+		s := newTestSystem(t)
+		s.Stops[0].Coord = c
+		problems := s.validate()
+		if len(problems) != 1 || !strings.HasPrefix(problems[0].Error(), "Coordinates out of range") {
+			t.Errorf("%v: problems = %v, want coordinates out of range", c, problems)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	s := newTestSystem(t)
+	w := do(s.handleNearest, "GET", "/nearest?lat=37.7791&lon=-122.4139&n=2", "")
+	nearby := decode[[]struct {
+		ID             string  `json:"id"`
+		DistanceMeters float64 `json:"distanceMeters"`
+	}](t, w)
+	if len(nearby) != 2 || nearby[0].ID != "civic" || nearby[1].ID != "cafe" {
+		t.Fatalf("got %s, want civic then cafe", w.Body)
+	}
+	if !(nearby[0].DistanceMeters < nearby[1].DistanceMeters) {
+		t.Errorf("distances %g and %g out of order", nearby[0].DistanceMeters, nearby[1].DistanceMeters)
+	}
+
+	for _, query := range []string{"lat=37.78", "lat=x&lon=1", "lat=NaN&lon=-122.41", "lat=37.78&lon=Inf", "lat=-Inf&lon=0"} {
+		if w := do(s.handleNearest, "GET", "/nearest?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+}
+
+// Wait up to a second for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestPollUpdateFile(t *testing.T) {
+	s := useMainSystem(t)
+	logs := captureLogs(t)
+	filename := filepath.Join(t.TempDir(), "update.json")
+	cafe := s.stopMap["cafe"]
+	times := func() []int {
+		s.RLock()
+		defer s.RUnlock()
+		cafe.RLock()
+		defer cafe.RUnlock()
+		return slices.Clone(cafe.Lines[0]["red"].Times)
+	}
+
+	// Each version gets its own modification time, however quickly
+	// they are written
+	mtime := time.Now().Add(-time.Hour)
+	write := func(body string) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Minute)
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		pollUpdateFile(ctx, filename, 5*time.Millisecond)
+		close(done)
+	}()
+
+	eventually(t, "a missing file to be reported", func() bool { return strings.Contains(logs.String(), "Unable to read update file") })
+	write(`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`)
+	eventually(t, "the first update", func() bool { return slices.Equal(times(), []int{3}) })
+
+	write(`{"stops":[{"stationID":"cafe","lines":[`)
+	eventually(t, "a malformed file to be reported", func() bool { return strings.Contains(logs.String(), "Unable to apply update file") })
+	if got := times(); !slices.Equal(got, []int{3}) {
+		t.Errorf("a malformed file changed the times to %v", got)
+	}
+
+	write(`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[7,12]}]}]}`)
+	eventually(t, "the second update", func() bool { return slices.Equal(times(), []int{7, 12}) })
+
+	cancel()
+	<-done
+}
+
+func TestUpdateFileTooLarge(t *testing.T) {
+	s := useMainSystem(t)
+	filename := filepath.Join(t.TempDir(), "update.json")
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+	if err := os.WriteFile(filename, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	setFlag(t, &maxBody, int64(len(body)-1))
+	if err := applyUpdateFile(filename); err == nil || !strings.Contains(err.Error(), "Update file too large") {
+		t.Errorf("got %v, want the file reported as too large", err)
+	}
+	if times := s.stopMap["cafe"].Lines[0]["red"].Times; len(times) != 0 {
+		t.Errorf("a file over the limit applied %v", times)
+	}
+
+	// Exactly at the limit is fine
+	maxBody = int64(len(body))
+	if err := applyUpdateFile(filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchFeed(t *testing.T) {
+	s := useMainSystem(t)
+	times := func() []int {
+		s.RLock()
+		defer s.RUnlock()
+		cafe := s.stopMap["cafe"]
+		cafe.RLock()
+		defer cafe.RUnlock()
+		return slices.Clone(cafe.Lines[0]["red"].Times)
+	}
+
+	var status int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	m := &feedMapping{Records: "data.arrivals", Station: "stop", Line: "route", Times: "minutes"}
+
+	status, body = http.StatusOK, `{"data":{"arrivals":[{"stop":"cafe","route":"red","minutes":[9,3]}]}}`
+	if err := fetchFeed(context.Background(), srv.Client(), srv.URL, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := times(); !slices.Equal(got, []int{3, 9}) {
+		t.Fatalf("times = %v, want [3 9]", got)
+	}
+
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusInternalServerError, `{"data":{"arrivals":[{"stop":"cafe","route":"red","minutes":[1]}]}}`, "Unexpected status"},
+		{http.StatusOK, `{"data":{"arrivals":[{"stop":"cafe","route":"red","minutes":[1]`, "Malformed json feed"},
+	} {
+		status, body = tc.status, tc.body
+		err := fetchFeed(context.Background(), srv.Client(), srv.URL, m)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("status %d, %s: got %v, want %q", tc.status, tc.body, err, tc.want)
+		}
+		if got := times(); !slices.Equal(got, []int{3, 9}) {
+			t.Errorf("status %d, %s: times changed to %v", tc.status, tc.body, got)
+		}
+	}
+}
+
+func TestLineInfo(t *testing.T) {
+	s := newTestSystem(t)
+	s.processUpdates(&update{Stops: []stationUpdate{
+		{StationID: "cafe", Lines: []lineUpdate{{LineID: "red", Index: 1, Times: []int{4}}}},
+		{StationID: "civic", Lines: []lineUpdate{{LineID: "red", Index: 0, Times: []int{2, 6}}}},
+	}}, false)
+
+	info := decode[lineInfo](t, do(s.handleLineInfo, "GET", "/line?id=red", ""))
+	want := lineInfo{ID: "red", Name: "Red", Color: "#f00", Stops: []lineStop{
+		{"cafe", 0, []int{}},
+		{"cafe", 1, []int{4}},
+		{"civic", 0, []int{2, 6}},
+	}}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	for _, target := range []string{"/line", "/line?id=purple"} {
+		if w := do(s.handleLineInfo, "GET", target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	s := newTestSystem(t)
+	for _, tc := range []struct {
+		h      http.HandlerFunc
+		target string
+	}{
+		{s.handleInfo, "/info"},
+		{s.handleStopInfo, "/stop?id=cafe"},
+		{s.handleStops, "/stops"},
+	} {
+		sep := "?"
+		if strings.Contains(tc.target, "?") {
+			sep = "&"
+		}
+		pretty := do(tc.h, "GET", tc.target+sep+"pretty=true", "")
+		body := strings.TrimSuffix(pretty.Body.String(), "\n")
+		if !strings.Contains(body, "\n  ") || !json.Valid(pretty.Body.Bytes()) {
+			t.Errorf("%s: not indented:\n%s", tc.target, body)
+		}
+		if ct := pretty.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q", tc.target, ct)
+		}
+
+		compact := do(tc.h, "GET", tc.target, "")
+		if strings.Contains(strings.TrimSuffix(compact.Body.String(), "\n"), "\n") {
+			t.Errorf("%s: indented without ?pretty=true", tc.target)
+		}
+	}
+}
+
+func TestConfigCoordinates(t *testing.T) {
+	config := func(lat, lon float64) io.Reader {
+		return strings.NewReader(fmt.Sprintf(`{"stops":[{"id":"pier","coord":{"lat":%g,"lon":%g}}]}`, lat, lon))
+	}
+	for _, c := range []coordinates{{37.8, -122.4}, {90, 180}, {-90, -180}} {
+		if _, err := parseConfig(config(c.Lat, c.Lon), "test"); err != nil {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+	for _, c := range []coordinates{{37.8, 1220}, {91, 0}, {-90.5, 10}, {10, -180.1}} {
+		_, err := parseConfig(config(c.Lat, c.Lon), "test")
+		if err == nil || !strings.Contains(err.Error(), "Coordinates out of range") || !strings.Contains(err.Error(), "station pier") {
+			t.Errorf("%v: got %v", c, err)
+		}
+	}
+
+	if _, err := parseConfig(config(0, 0), "test"); err == nil || !strings.Contains(err.Error(), "-allowNullIsland") {
+		t.Errorf("(0, 0): got %v", err)
+	}
+	setFlag(t, &allowNullIsland, true)
+	if _, err := parseConfig(config(0, 0), "test"); err != nil {
+		t.Errorf("(0, 0) with -allowNullIsland: %v", err)
+	}
+}
+
+func TestStaleWatchdog(t *testing.T) {
+	s := newTestSystem(t)
+	logs := captureLogs(t)
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	setFlag(t, &startTime, start)
+	setFlag(t, &mainMetrics, newMetrics())
+
+	after := 5 * time.Minute
+	stale := false
+	for _, step := range []struct {
+		now             time.Duration // Since start
+		update          bool          // Apply an update first
+		stale           bool
+		warned, resumed int     // Warnings and recoveries logged so far
+		events          float64 // Times the watchdog has fired
+	}{
+		{now: 4 * time.Minute},
+		{now: 6 * time.Minute, stale: true, warned: 1, events: 1},
+		{now: 9 * time.Minute, stale: true, warned: 1, events: 1},
+		{now: 10 * time.Minute, update: true, warned: 1, resumed: 1, events: 1},
+		{now: 16 * time.Minute, stale: true, warned: 2, resumed: 1, events: 2},
+	} {
+		now := start.Add(step.now)
+		if step.update {
+			s.lastUpdate.Store(now.UnixNano())
+		}
+		stale = s.checkStale(slog.Default(), now, after, stale)
+
+		fired, flagged := testutil.ToFloat64(mainMetrics.staleEvents), testutil.ToFloat64(mainMetrics.stale) == 1
+		warned, resumed := strings.Count(logs.String(), "No updates received"), strings.Count(logs.String(), "Updates resumed")
+		if stale != step.stale || flagged != step.stale || warned != step.warned || resumed != step.resumed || fired != step.events {
+			t.Errorf("at +%v: got stale %v (metric %v), %d warnings, %d recoveries and %g events; want %v, %d, %d and %g",
+				step.now, stale, flagged, warned, resumed, fired, step.stale, step.warned, step.resumed, step.events)
+		}
+	}
+}
+
+func TestMultipleSystems(t *testing.T) {
+	east, west := newTestSystem(t), newTestSystem(t)
+	setFlag(t, &mux, http.NewServeMux())
+	setFlag(t, &systems, []*hostedSystem{{name: "east", source: "east.json", sys: east}, {name: "west", source: "west.json", sys: west}})
+	setupRoutes()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp := fetch(t, srv, "POST", "/east/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`, "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: got %d", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want []int
+	}{
+		{"/east/stop?id=cafe", []int{3}},
+		{"/west/stop?id=cafe", []int{}},
+	} {
+		var stop station
+		if err := json.NewDecoder(fetch(t, srv, "GET", tc.path, "").Body).Decode(&stop); err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if got := stop.Lines[0]["red"].Times; !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.path, got, tc.want)
+		}
+	}
+
+	// Without a single system, nothing is served at the root
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/info: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestIsValidColor(t *testing.T) {
+	for c, want := range map[string]bool{
+		"":         false,
+		"#f00":     true,
+		"#FF8800":  true,
+		"#a1B2c3":  true,
+		"f00":      false,
+		"#ff":      false,
+		"#ff00":    false,
+		"#gg0000":  false,
+		"#ff00000": false,
+		"red":      false,
+	} {
+		if got := isValidColor(c); got != want {
+			t.Errorf("isValidColor(%q) = %v, want %v", c, got, want)
+		}
+	}
+}
+
+func TestColorChecked(t *testing.T) {
+	_, err := parseConfig(strings.NewReader(`{"stops":[{"id":"a","coord":{"lat":1,"lon":1},"directions":["N","S"],"lines":[{"x":{"id":"x","color":"#ff00zz"}},{}]}]}`), "test")
+	if err == nil || !strings.Contains(err.Error(), "Invalid color (#ff00zz) for station a, line x") {
+		t.Errorf("config: got %v", err)
+	}
+	if _, err := parseConfig(strings.NewReader(`{"stops":[{"id":"a","name":"A","coord":{"lat":1,"lon":1},"directions":["N","S"],"lines":[{"x":{"id":"x","name":"X"}},{}]}]}`), "test"); err != nil {
+		t.Errorf("config without a color: %v", err)
+	}
+
+	s := newTestSystem(t)
+	w := do(s.handleLineColor, "PATCH", "/line/color", `{"lineID":"red","color":"reddish"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("/line/color: got %d, want 400", w.Code)
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Color; got != "#f00" {
+		t.Errorf("an invalid color was applied: %q", got)
+	}
+}
+
+// Run fn, returning what it writes to standard output
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	fn()
+	os.Stdout = old
+	w.Close()
+	return <-out
+}
+
+func TestValidateConfigs(t *testing.T) {
+	var status int
+	out := captureStdout(t, func() { status = validateConfigs([]string{"../../example-config.json"}, "testdata/gtfs") })
+	if status != 0 || !strings.Contains(out, "../../example-config.json: OK") || !strings.Contains(out, "testdata/gtfs: OK (2 stations)") {
+		t.Errorf("good fixtures: got status %d:\n%s", status, out)
+	}
+
+	out = captureStdout(t, func() {
+		status = validateConfigs([]string{"../../example-config.json", "testdata/bad-config.json", "testdata/missing.json"}, "")
+	})
+	if status == 0 {
+		t.Error("bad fixtures: got status 0")
+	}
+	for _, want := range []string{
+		"../../example-config.json: OK",
+		"Duplicate station ID (first) at stops 0 and 1",
+		"Coordinates out of range (37.78, 1220) for station first",
+		"Missing name for station first, direction 1",
+		"Invalid color (blue) for station first, line y",
+		"Unable to open configuration file (testdata/missing.json)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("bad fixtures: output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestSingleDirectionStation(t *testing.T) {
+	s := newTestSystem(t)
+	emb := s.stopMap["emb"]
+	if emb.Lines[1] == nil || s.stopMap["civic"].Lines[1] == nil {
+		t.Error("an empty direction was left nil")
+	}
+
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"emb","lines":[{"lineID":"green","index":1,"times":[3]}]}]}`)
+	errs := decode[updateErrors](t, w)
+	if w.Code != http.StatusBadRequest || !slices.Equal(errs.Errors, []string{"No lines configured for station emb, direction 1"}) {
+		t.Errorf("got %d %q", w.Code, errs.Errors)
+	}
+
+	if _, err := s.processUpdates(lineTimes("emb", "green", 0, 3), false); err != nil {
+		t.Errorf("the populated direction: %v", err)
+	}
+	stop := decode[station](t, do(s.handleStopInfo, "GET", "/stop?id=emb", ""))
+	if len(stop.Lines[1]) != 0 || !slices.Equal(stop.Lines[0]["green"].Times, []int{3}) {
+		t.Errorf("got lines %v", stop.Lines)
+	}
+}
+
+func TestStopDirections(t *testing.T) {
+	s := newTestSystem(t)
+	for id, want := range map[string][]stopDirection{
+		"cafe": {{0, "N"}, {1, "S"}},
+		"emb":  {{0, "In"}, {1, "Out"}},
+	} {
+		w := do(s.handleStopDirections, "GET", "/stop/directions?id="+id, "")
+		if got := decode[[]stopDirection](t, w); !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", id, got, want)
+		}
+	}
+
+	if w := do(s.handleStopDirections, "GET", "/stop/directions?id=nowhere", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown station: got %d, want 400", w.Code)
+	}
+}
+
+func TestUpdateDropsExpiredTimes(t *testing.T) {
+	s := newTestSystem(t)
+	red := s.stopMap["cafe"].Lines[0]["red"]
+	s.processUpdates(lineTimes("cafe", "red", 0, 4, -3, 0, 1, -1, 9), false)
+	if !slices.Equal(red.Times, []int{1, 4, 9}) {
+		t.Errorf("got %v, want [1 4 9]", red.Times)
+	}
+
+	setFlag(t, &expiredThreshold, 2)
+	s.processUpdates(lineTimes("cafe", "red", 0, 2, 3, 1, 8), false)
+	if !slices.Equal(red.Times, []int{3, 8}) {
+		t.Errorf("with -expiredThreshold=2 got %v, want [3 8]", red.Times)
+	}
+	s.countdown()
+	if !slices.Equal(red.Times, []int{7}) {
+		t.Errorf("after a countdown got %v, want [7]", red.Times)
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	s := newTestSystem(t)
+	s.processUpdates(lineTimes("cafe", "red", 0, 3), false)
+	s.modified.Store(time.Now().Add(-time.Minute).UnixNano())
+	modified := s.lastModified()
+
+	for _, tc := range []struct {
+		h      http.HandlerFunc
+		target string
+	}{
+		{s.handleInfo, "/info"},
+		{s.handleStopInfo, "/stop?id=cafe"},
+	} {
+		for _, since := range []struct {
+			at   time.Time
+			want int
+		}{
+			{modified.Add(time.Hour), http.StatusNotModified},
+			{modified, http.StatusNotModified},
+			{modified.Add(-time.Second), http.StatusOK},
+		} {
+			r := httptest.NewRequest("GET", tc.target, nil)
+			r.Header.Set("If-Modified-Since", since.at.Format(http.TimeFormat))
+			w := httptest.NewRecorder()
+			tc.h(w, r)
+			if w.Code != since.want {
+				t.Errorf("%s since %v: got %d, want %d", tc.target, since.at, w.Code, since.want)
+			}
+			if got := w.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+				t.Errorf("%s: got Last-Modified %q, want %q", tc.target, got, modified.Format(http.TimeFormat))
+			}
+		}
+	}
+}
+
+func TestIfModifiedSinceSameSecond(t *testing.T) {
+	s := newTestSystem(t)
+	for _, tc := range []struct {
+		h      http.HandlerFunc
+		target string
+	}{
+		{s.handleInfo, "/info"},
+		{s.handleStopInfo, "/stop?id=cafe"},
+	} {
+		// A client that fetched earlier this second, before the update.
+		// Retry should the second end before the conditional GET.
+		for n := 5; ; n++ {
+			start := time.Now()
+			s.processUpdates(lineTimes("cafe", "red", 0, 3, n), false)
+			r := httptest.NewRequest("GET", tc.target, nil)
+			r.Header.Set("If-Modified-Since", start.UTC().Format(http.TimeFormat))
+			w := httptest.NewRecorder()
+			tc.h(w, r)
+			if !time.Now().Truncate(time.Second).Equal(start.Truncate(time.Second)) {
+				continue
+			}
+
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: got %d, want %d", tc.target, w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Last-Modified"); got != "" {
+				t.Errorf("%s: got Last-Modified %q within the second of the update, want none", tc.target, got)
+			}
+			break
+		}
+	}
+}
+
+// Read the next event from a /stream response, skipping heartbeats
+func readEvent(t *testing.T, r *bufio.Reader) (kind, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			kind = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && kind != "":
+			return kind, data
+		}
+	}
+}
+
+func TestShortWriteTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	setFlag(t, &writeTimeout, timeout)
+	s := newTestSystem(t)
+	routeTestSystem(t, s)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.WriteTimeout = timeout
+	srv.Start()
+	defer srv.Close()
+
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/info: got %d", resp.StatusCode)
+	}
+
+	// Streams get a fresh deadline for every event, so they outlast
+	// the server's timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream", nil)
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	if kind, _ := readEvent(t, events); kind != "snapshot" {
+		t.Fatalf("got a %s first, want a snapshot", kind)
+	}
+
+	time.Sleep(3 * timeout)
+	s.processUpdates(lineTimes("cafe", "red", 0, 3), false)
+	if kind, _ := readEvent(t, events); kind != "delta" {
+		t.Errorf("got a %s after the timeout, want a delta", kind)
+	}
+
+	// Hanging up ends the handler
+	cancel()
+	eventually(t, "the stream to unsubscribe", func() bool {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		return len(s.subscribers) == 0
+	})
+}
+
+func TestErrorsAreJSON(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	s := newTestSystem(t)
+	for _, tc := range []struct {
+		name              string
+		h                 http.HandlerFunc
+		target, key, body string
+		code              int
+	}{
+		{"unknown stop", s.handleStopInfo, "/stop?id=nowhere", "", "", http.StatusBadRequest},
+		{"missing stop", s.handleStopInfo, "/stop", "", "", http.StatusBadRequest},
+		{"bad key", s.handleUpdate, "/update", "guess", `{"stops":[]}`, http.StatusUnauthorized},
+		{"malformed", s.handleUpdate, "/update", "sekrit", `{"stops":`, http.StatusBadRequest},
+		{"invalid", s.handleUpdate, "/update", "sekrit", `{"stops":[{"stationID":"nowhere","lines":[]}]}`, http.StatusBadRequest},
+	} {
+		method := "GET"
+		if tc.body != "" {
+			method = "POST"
+		}
+		r := httptest.NewRequest(method, tc.target, strings.NewReader(tc.body))
+		r.Header.Set("X-API-Key", tc.key)
+		w := httptest.NewRecorder()
+		tc.h(w, r)
+
+		var body struct {
+			Error  string   `json:"error"`
+			Errors []string `json:"errors"`
+		}
+		if w.Code != tc.code || w.Header().Get("Content-Type") != "application/json" || json.Unmarshal(w.Body.Bytes(), &body) != nil || body.Error == "" && len(body.Errors) == 0 {
+			t.Errorf("%s: got %d %s %q, want %d with a JSON error", tc.name, w.Code, w.Header().Get("Content-Type"), w.Body, tc.code)
+		}
+	}
+}
+
+func TestInfoHead(t *testing.T) {
+	s := newTestSystem(t)
+	s.modified.Store(time.Now().Add(-time.Minute).UnixNano())
+	get := do(s.handleInfo, "GET", "/info", "")
+	head := do(s.handleInfo, "HEAD", "/info", "")
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("got %d with %d bytes, want an empty 200", head.Code, head.Body.Len())
+	}
+	for _, name := range []string{"Content-Type", "ETag", "Last-Modified"} {
+		if got, want := head.Header().Get(name), get.Header().Get(name); got == "" || got != want {
+			t.Errorf("%s: got %q, want %q as for GET", name, got, want)
+		}
+	}
+}
+
+func TestConcurrentUpdateLimit(t *testing.T) {
+	slots := make(chan struct{}, 2)
+	setFlag(t, &updateSlots, slots)
+	s := newTestSystem(t)
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+
+	// Two updates already in progress
+	slots <- struct{}{}
+	slots <- struct{}{}
+	w := do(s.handleUpdate, "POST", "/update", body)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("saturated: got %d with Retry-After %q, want 503 with one", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Times; len(got) != 0 {
+		t.Errorf("a turned away update was applied: %v", got)
+	}
+
+	// Once one finishes, the next gets through, and gives its slot back
+	<-slots
+	if w := do(s.handleUpdate, "POST", "/update", body); w.Code != http.StatusOK {
+		t.Errorf("with a free slot: got %d", w.Code)
+	}
+	if len(slots) != 1 {
+		t.Errorf("%d slots taken afterwards, want 1", len(slots))
+	}
+}
+
+func TestCaseInsensitiveIDs(t *testing.T) {
+	body := `{"stops":[{"stationID":"CAFE","lines":[{"lineID":"Red","index":0,"times":[3]}]}]}`
+	if w := do(newTestSystem(t).handleUpdate, "POST", "/update", body); w.Code != http.StatusBadRequest {
+		t.Errorf("without -caseInsensitiveIDs: got %d, want 400", w.Code)
+	}
+
+	setFlag(t, &caseInsensitiveIDs, true)
+	s := newTestSystem(t)
+	if w := do(s.handleUpdate, "POST", "/update", body); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	stop := decode[station](t, do(s.handleStopInfo, "GET", "/stop?id=Cafe", ""))
+	red := stop.Lines[0]["red"]
+	if stop.ID != "cafe" || red == nil || red.ID != "red" || !slices.Equal(red.Times, []int{3}) {
+		t.Errorf("got station %q with red %+v, want the original casing and the new times", stop.ID, red)
+	}
+
+	// /lines lists a line once, however each station cases it
+	for _, st := range s.Stops {
+		if st.ID == "civic" {
+			st.Lines[0]["red"].ID = "RED"
+		}
+	}
+	reds := 0
+	for _, ln := range decode[[]lineSummary](t, do(s.handleLines, "GET", "/lines", "")) {
+		if strings.EqualFold(ln.ID, "red") {
+			reds++
+		}
+	}
+	if reds != 1 {
+		t.Errorf("/lines listed red %d times, want once", reds)
+	}
+
+	// IDs then have to be unique regardless of case
+	_, err := parseConfig(strings.NewReader(`{"stops":[{"id":"a","coord":{"lat":1,"lon":1}},{"id":"A","coord":{"lat":1,"lon":1}}]}`), "test")
+	if err == nil || !strings.Contains(err.Error(), "Duplicate station ID (A)") {
+		t.Errorf("got %v, want the IDs reported as duplicates", err)
+	}
+}
+
+func TestStopBatch(t *testing.T) {
+	s := newTestSystem(t)
+	for _, w := range []*httptest.ResponseRecorder{
+		do(s.handleStopBatch, "GET", "/stop/batch?ids=cafe,nowhere,emb", ""),
+		do(s.handleStopBatch, "POST", "/stop/batch", `{"ids":["cafe","nowhere","emb"]}`),
+	} {
+		var batch struct {
+			Stops   map[string]struct{ Name string }
+			Unknown []string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+			t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+		}
+		if len(batch.Stops) != 2 || batch.Stops["cafe"].Name != "Café Central" || batch.Stops["emb"].Name != "Embarcadero" {
+			t.Errorf("got stops %v, want cafe and emb", batch.Stops)
+		}
+		if !slices.Equal(batch.Unknown, []string{"nowhere"}) {
+			t.Errorf("got unknown %v, want [nowhere]", batch.Unknown)
+		}
+	}
+
+	tooMany := strings.Repeat("cafe,", maxBatchStops) + "cafe"
+	for _, target := range []string{"/stop/batch", "/stop/batch?ids=" + tooMany} {
+		if w := do(s.handleStopBatch, "GET", target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: got %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestMalformedUpdateResponses(t *testing.T) {
+	s := newTestSystem(t)
+	post := func(body, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.handleUpdate(w, r)
+		return w
+	}
+
+	// A browser posting the form gets the page
+	w := post("{not json", "text/html,application/xhtml+xml,*/*;q=0.8")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("browser: got %d %.60q, want 400 and the page", w.Code, w.Body)
+	}
+
+	// A script gets the reason
+	w = post("{not json", "application/json")
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("script: got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if e := decode[apiError](t, w); e.Error != "malformed json" || e.Detail == "" {
+		t.Errorf("script: got %+v", e)
+	}
+
+	// Well-formed updates that don't check out are listed instead
+	w = post(`{"stops":[{"stationID":"nowhere","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`, "application/json")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid update: got %d", w.Code)
+	}
+	if e := decode[updateErrors](t, w); !slices.Equal(e.Errors, []string{"Invalid station ID (nowhere)"}) {
+		t.Errorf("invalid update: got %q", e.Errors)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	setFlag(t, &basePath, "/transit")
+	srv := newTestServer(t, newTestSystem(t))
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/transit/info", http.StatusOK},
+		{"/transit/stop?id=cafe", http.StatusOK},
+		{"/transit/static/update.html", http.StatusOK},
+		{"/transit/healthz", http.StatusOK},
+		{"/info", http.StatusNotFound},
+		{"/static/update.html", http.StatusNotFound},
+	} {
+		if resp := fetch(t, srv, "GET", tc.path, ""); resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestLineDestination(t *testing.T) {
+	config := strings.Replace(testConfig, `"id":"red","color":"#f00"}`, `"id":"red","color":"#f00","destination":"Ocean Beach"}`, 1)
+	s, err := parseConfig(strings.NewReader(config), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.loaded = true
+
+	type stop struct {
+		ID    string
+		Lines []map[string]struct{ Destination string }
+	}
+	check := func(what string, st stop) {
+		t.Helper()
+		if got := st.Lines[0]["red"].Destination; got != "Ocean Beach" {
+			t.Errorf("%s: got red destination %q, want Ocean Beach", what, got)
+		}
+		if got := st.Lines[1]["red"].Destination; got != "" {
+			t.Errorf("%s: got %q for a line without a destination", what, got)
+		}
+	}
+
+	info := decode[struct{ Stops []stop }](t, do(s.handleInfo, "GET", "/info", ""))
+	i := slices.IndexFunc(info.Stops, func(st stop) bool { return st.ID == "cafe" })
+	if i < 0 {
+		t.Fatalf("cafe missing from /info: %+v", info.Stops)
+	}
+	check("/info", info.Stops[i])
+	check("/stop", decode[stop](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", "")))
+}
+
+func TestEmptyConfig(t *testing.T) {
+	for _, config := range []string{"{}", ""} {
+		_, err := parseConfig(strings.NewReader(config), "empty.json")
+		if err == nil || !strings.Contains(err.Error(), "No stations configured") {
+			t.Errorf("%q: got %v, want no stations configured", config, err)
+		}
+	}
+
+	setFlag(t, &allowEmpty, true)
+	logs := captureLogs(t)
+	s, err := parseConfig(strings.NewReader("{}"), "empty.json")
+	if err != nil {
+		t.Fatalf("with -allowEmpty: %v", err)
+	}
+	if len(s.Stops) != 0 {
+		t.Errorf("got %d stops, want none", len(s.Stops))
+	}
+	if !strings.Contains(logs.String(), "no timeMax") {
+		t.Errorf("no warning about timeMax in %q", logs)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	srv := newTestServer(t, newTestSystem(t))
+	handle("/boom", "boom", func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	})
+	logs := captureLogs(t)
+
+	resp := fetch(t, srv, "GET", "/boom", "")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", resp.StatusCode)
+	}
+	if !strings.Contains(logs.String(), "Handler panicked") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("panic not logged with its stack: %q", logs)
+	}
+
+	// Everything else still works
+	if resp := fetch(t, srv, "GET", "/info", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the panic, /info got %d", resp.StatusCode)
+	}
+}
+
+func TestInfoSort(t *testing.T) {
+	config := strings.Replace(testConfig, `"id":"civic",`, `"id":"civic","sequence":2,`, 1)
+	config = strings.Replace(config, `"id":"emb",`, `"id":"emb","sequence":1,`, 1)
+	s, err := parseConfig(strings.NewReader(config), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.loaded = true
+
+	for _, tc := range []struct {
+		target string
+		want   []string
+	}{
+		{"/info", []string{"Embarcadero", "Civic Center", "Café Central"}},
+		{"/info?sort=name", []string{"Café Central", "Civic Center", "Embarcadero"}},
+	} {
+		info := decode[struct{ Stops []struct{ Name string } }](t, do(s.handleInfo, "GET", tc.target, ""))
+		var got []string
+		for _, st := range info.Stops {
+			got = append(got, st.Name)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.target, got, tc.want)
+		}
+	}
+
+	if w := do(s.handleInfo, "GET", "/info?sort=color", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: got %d, want 400", w.Code)
+	}
+}
+
+// Decode a msgpack response into v
+func unmarshalMsgpack(t *testing.T, body []byte, v any) {
+	t.Helper()
+	if err := msgpack.Unmarshal(body, v); err != nil {
+		t.Fatalf("decoding % x: %v", body, err)
+	}
+}
+
+// Move a station's updatedAt times to UTC, since msgpack timestamps
+// decode in the local time zone
+func updatedInUTC(stops ...*stationSnapshot) {
+	for _, stop := range stops {
+		for _, lines := range stop.Lines {
+			for _, ln := range lines {
+				if ln.UpdatedAt != nil {
+					utc := ln.UpdatedAt.UTC()
+					ln.UpdatedAt = &utc
+				}
+			}
+		}
+	}
+}
+
+func TestMsgpackResponses(t *testing.T) {
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3, 12), false); err != nil {
+		t.Fatal(err)
+	}
+	get := func(h http.HandlerFunc, target, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	var fromMsgpack, fromJSON systemSnapshot
+	w := get(s.handleInfo, "/info", "application/msgpack")
+	if ct := w.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Errorf("/info: got Content-Type %q", ct)
+	}
+	unmarshalMsgpack(t, w.Body.Bytes(), &fromMsgpack)
+	if err := json.Unmarshal(get(s.handleInfo, "/info", "application/json").Body.Bytes(), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	updatedInUTC(fromMsgpack.Stops...)
+	updatedInUTC(fromJSON.Stops...)
+	if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+		t.Errorf("/info: msgpack gave %+v, JSON %+v", fromMsgpack, fromJSON)
+	}
+
+	var stop stationSnapshot
+	w = get(s.handleStopInfo, "/stop?id=cafe", "application/msgpack")
+	if ct := w.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Errorf("/stop: got Content-Type %q", ct)
+	}
+	unmarshalMsgpack(t, w.Body.Bytes(), &stop)
+	if red := stop.Lines[0]["red"]; stop.ID != "cafe" || !slices.Equal(red.Times, []int{3, 12}) || red.UpdatedAt == nil {
+		t.Errorf("/stop: got %s with red %+v", stop.ID, red)
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	setFlag(t, &timeZone, loc)
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3), false); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := decode[struct {
+		Lines []map[string]struct {
+			UpdatedAt string `json:"updatedAt"`
+		}
+	}](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", ""))
+	updated := stop.Lines[0]["red"].UpdatedAt
+	at, err := time.Parse(time.RFC3339Nano, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := at.In(loc).Format("-07:00"); !strings.HasSuffix(updated, want) {
+		t.Errorf("got updatedAt %q, want the offset %s", updated, want)
+	}
+}
+
+func TestLinesNear(t *testing.T) {
+	s := newTestSystem(t)
+	for _, u := range []*update{lineTimes("cafe", "red", 0, 9), lineTimes("civic", "red", 0, 4), lineTimes("cafe", "blue", 0, 6)} {
+		if _, err := s.processUpdates(u, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Café Central and Civic Center are a few hundred meters apart;
+	// the Embarcadero is too far
+	w := do(s.handleLinesNear, "GET", "/lines/near?lat=37.78&lon=-122.41&radius=1000", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	lines := decode[[]nearbyLine](t, w)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want red and blue: %s", len(lines), w.Body)
+	}
+	red, blue := lines[0], lines[1]
+	if red.ID != "red" || red.Soonest == nil || *red.Soonest != 4 || !slices.Equal(red.StationIDs, []string{"cafe", "civic"}) {
+		t.Errorf("got %+v, want red in 4 at cafe and civic", red)
+	}
+	if blue.ID != "blue" || blue.Soonest == nil || *blue.Soonest != 6 || !slices.Equal(blue.StationIDs, []string{"cafe"}) {
+		t.Errorf("got %+v, want blue in 6 at cafe", blue)
+	}
+
+	for _, radius := range []string{"0", "-5", "5001", "far"} {
+		if w := do(s.handleLinesNear, "GET", "/lines/near?lat=37.78&lon=-122.41&radius="+radius, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("radius %s: got %d, want 400", radius, w.Code)
+		}
+	}
+}
+
+func TestProcessUpdatesCounts(t *testing.T) {
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged lines, and stations with only those, aren't counted
+	mixed := func(extra ...stationUpdate) *update {
+		return &update{Stops: append([]stationUpdate{
+			{StationID: "cafe", Lines: []lineUpdate{{LineID: "red", Index: 0, Times: []int{3}}, {LineID: "blue", Index: 0, Times: []int{5}}}},
+			{StationID: "civic", Lines: []lineUpdate{{LineID: "red", Index: 0, Times: []int{3}}}},
+			{StationID: "emb", Lines: []lineUpdate{{LineID: "green", Index: 0, Times: []int{7}}}},
+		}, extra...)}
+	}
+	for _, dryRun := range []bool{true, false} {
+		sum, err := s.processUpdates(mixed(), dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum.StationsUpdated != 3 || sum.LinesUpdated != 3 || sum.DryRun != dryRun || len(sum.Errors) != 0 {
+			t.Errorf("dry run %t: got %+v, want 3 stations and 3 lines", dryRun, sum)
+		}
+	}
+
+	// The batch has now been applied, so sending it again changes nothing
+	if sum, err := s.processUpdates(mixed(), false); err != nil || sum.StationsUpdated != 0 || sum.LinesUpdated != 0 {
+		t.Errorf("again: got %+v, %v, want nothing updated", sum, err)
+	}
+
+	// Mistakes are all listed, and nothing is counted
+	sum, err := s.processUpdates(mixed(
+		stationUpdate{StationID: "nowhere", Lines: []lineUpdate{{LineID: "red", Index: 0, Times: []int{1}}}},
+		stationUpdate{StationID: "cafe", Lines: []lineUpdate{{LineID: "blue", Index: 0, Times: []int{99}}}},
+	), false)
+	want := []string{"Invalid station ID (nowhere)", "Time out of range (99) for station cafe, line blue"}
+	if err == nil || sum.StationsUpdated != 0 || sum.LinesUpdated != 0 || !slices.Equal(sum.Errors, want) {
+		t.Errorf("got %+v, %v, want the errors %q", sum, err, want)
+	}
+}
+
+func TestStationAlert(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	srv := newTestServer(t, newTestSystem(t))
+	stopAlert := func() string {
+		t.Helper()
+		var stop struct{ Alert string }
+		if err := json.NewDecoder(fetch(t, srv, "GET", "/stop?id=civic", "").Body).Decode(&stop); err != nil {
+			t.Fatal(err)
+		}
+		return stop.Alert
+	}
+
+	set := `{"stationID":"civic","alert":"Elevator out at Civic Center"}`
+	if resp := fetch(t, srv, "POST", "/alert", set); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the key: got %d, want 401", resp.StatusCode)
+	}
+	if resp := fetch(t, srv, "POST", "/alert", set, "X-API-Key", "sekrit"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set: got %d", resp.StatusCode)
+	}
+	if got := stopAlert(); got != "Elevator out at Civic Center" {
+		t.Errorf("got alert %q after setting it", got)
+	}
+
+	if resp := fetch(t, srv, "POST", "/alert", `{"stationID":"civic","alert":""}`, "X-API-Key", "sekrit"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("clear: got %d", resp.StatusCode)
+	}
+	if got := stopAlert(); got != "" {
+		t.Errorf("got alert %q after clearing it", got)
+	}
+
+	if resp := fetch(t, srv, "POST", "/alert", `{"stationID":"nowhere","alert":"x"}`, "X-API-Key", "sekrit"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown station: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestStreamDeltaHasOnlyTouchedLines(t *testing.T) {
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream", nil)
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	if kind, _ := readEvent(t, events); kind != "snapshot" {
+		t.Fatalf("got a %s first, want a snapshot", kind)
+	}
+
+	if _, err := s.processUpdates(lineTimes("cafe", "blue", 0, 6), false); err != nil {
+		t.Fatal(err)
+	}
+	kind, data := readEvent(t, events)
+	if kind != "delta" {
+		t.Fatalf("got a %s after an update, want a delta", kind)
+	}
+	var delta struct {
+		Stops []struct {
+			ID    string
+			Lines []map[string]struct{ Times []int }
+		}
+	}
+	if err := json.Unmarshal([]byte(data), &delta); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if len(delta.Stops) != 1 || delta.Stops[0].ID != "cafe" {
+		t.Fatalf("got %s, want just cafe", data)
+	}
+	var lines []string
+	for dir, dirLines := range delta.Stops[0].Lines {
+		for id := range dirLines {
+			lines = append(lines, fmt.Sprintf("%s %d", id, dir))
+		}
+	}
+	if !slices.Equal(lines, []string{"blue 0"}) || !slices.Equal(delta.Stops[0].Lines[0]["blue"].Times, []int{6}) {
+		t.Errorf("got %s, want only blue in direction 0", data)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	setFlag(t, &cacheControl, "max-age=5")
+	srv := newTestServer(t, newTestSystem(t))
+	for _, path := range []string{"/info", "/stop?id=cafe", "/lines"} {
+		resp := fetch(t, srv, "GET", path, "")
+		if got := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusOK || got != "max-age=5" {
+			t.Errorf("%s: got %d with Cache-Control %q, want max-age=5", path, resp.StatusCode, got)
+		}
+
+		// Revalidating keeps the same lifetime
+		if tag := resp.Header.Get("ETag"); tag != "" {
+			resp := fetch(t, srv, "GET", path, "", "If-None-Match", tag)
+			if got := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusNotModified || got != "max-age=5" {
+				t.Errorf("%s revalidated: got %d with Cache-Control %q, want a 304 with max-age=5", path, resp.StatusCode, got)
+			}
+		}
+	}
+
+	// Errors aren't cached
+	if resp := fetch(t, srv, "GET", "/stop?id=nowhere", ""); resp.Header.Get("Cache-Control") == "max-age=5" {
+		t.Errorf("a %d was cached", resp.StatusCode)
+	}
+}
+
+func TestUntouchedTimesAreEmpty(t *testing.T) {
+	s := newTestSystem(t)
+	check := func(what string) {
+		t.Helper()
+		body := do(s.handleInfo, "GET", "/info", "").Body.String()
+		if strings.Contains(body, `"times":null`) {
+			t.Errorf("%s: /info has null times: %s", what, body)
+		}
+		var info struct {
+			Stops []struct {
+				Lines []map[string]struct{ Times *[]int }
+			}
+		}
+		if err := json.Unmarshal([]byte(body), &info); err != nil {
+			t.Fatal(err)
+		}
+		if times := info.Stops[0].Lines[0]["blue"].Times; times == nil || len(*times) != 0 {
+			t.Errorf("%s: got blue times %v, want []", what, times)
+		}
+	}
+	check("as configured")
+
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"blue","index":0,"times":null}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("null times: got %d %s", w.Code, w.Body)
+	}
+	check("updated with null")
+}
+
+func TestScaffold(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := scaffold(file); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("loading the scaffolded config: %v", err)
+	}
+	if len(s.Stops) != 1 || len(s.Stops[0].Lines[0]) != 1 || len(s.Stops[0].Lines[1]) != 1 {
+		t.Errorf("got %+v, want one station with a line each way", s.Stops)
+	}
+
+	// Someone's edits are never overwritten
+	if err := os.WriteFile(file, []byte("{edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := scaffold(file); err == nil {
+		t.Error("scaffolding over an existing file succeeded")
+	}
+	if body, _ := os.ReadFile(file); string(body) != "{edited" {
+		t.Errorf("the existing file was changed to %q", body)
+	}
+
+	out := captureStdout(t, func() {
+		if err := scaffold("-"); err != nil {
+			t.Error(err)
+		}
+	})
+	if _, err := parseConfig(strings.NewReader(out), "stdout"); err != nil {
+		t.Errorf("loading the scaffold from standard output: %v", err)
+	}
+}
+
+func TestDebugConfigRequiresKey(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "guess"} {
+		if resp := fetch(t, srv, "GET", "/debug/config", "", "X-API-Key", key); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("key %q: got %d, want 401", key, resp.StatusCode)
+		}
+	}
+	resp := fetch(t, srv, "GET", "/debug/config", "", "X-API-Key", "sekrit")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"id":"cafe"`) {
+		t.Fatalf("update key: got %d %s", resp.StatusCode, body)
+	}
+	if strings.Contains(string(body), `"times":[3]`) {
+		t.Errorf("live times in the config: %s", body)
+	}
+
+	// A separate debug key replaces the update key
+	setFlag(t, &debugKey, "peek")
+	if resp := fetch(t, srv, "GET", "/debug/config", "", "X-API-Key", "sekrit"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("update key with -debugKey: got %d, want 401", resp.StatusCode)
+	}
+	if resp := fetch(t, srv, "GET", "/debug/config", "", "X-API-Key", "peek"); resp.StatusCode != http.StatusOK {
+		t.Errorf("debug key: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestLineOrder(t *testing.T) {
+	config := `{"name":"Test","tagline":"t","timeMax":45,"stops":[
+{"name":"Hub","id":"hub","coord":{"lat":37.78,"lon":-122.41},"directions":["N","S"],"lines":[{
+"z":{"name":"Zed","id":"z","color":"#000"},
+"b2":{"name":"Bee","id":"b2","color":"#000"},
+"m":{"name":"Mid","id":"m","color":"#000","order":2},
+"b1":{"name":"Bee","id":"b1","color":"#000"},
+"f":{"name":"First","id":"f","color":"#000","order":1}},null]}
+]}`
+	s, err := parseConfig(strings.NewReader(config), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.loaded = true
+
+	// Ordered lines first, then by name, then by ID, every time; a
+	// direction filter keeps /info from reusing its cached body
+	want := []string{"f", "m", "b1", "b2", "z"}
+	type stop struct{ LineOrder [][]string }
+	for range 20 {
+		info := decode[struct{ Stops []stop }](t, do(s.handleInfo, "GET", "/info?direction=0", ""))
+		if got := info.Stops[0].LineOrder; len(got) == 0 || !slices.Equal(got[0], want) {
+			t.Fatalf("/info: got line order %q, want %q", got, want)
+		}
+		st := decode[stop](t, do(s.handleStopInfo, "GET", "/stop?id=hub", ""))
+		if got := st.LineOrder; len(got) != 2 || !slices.Equal(got[0], want) || len(got[1]) != 0 {
+			t.Fatalf("/stop: got line order %q, want %q and nothing the other way", got, want)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	entries := tempAuditLog(t)
+	s := newTestSystem(t)
+	before := time.Now()
+	w := do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[4]},{"lineID":"blue","index":0,"times":[8]}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	// Only accepted updates that were applied are recorded
+	do(s.handleUpdate, "POST", "/update", `{"stops":[{"stationID":"nowhere","lines":[]}]}`)
+	do(s.handleUpdate, "POST", "/update?dryRun=true", `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[5]}]}]}`)
+
+	got := entries()
+	if len(got) != 1 {
+		t.Fatalf("got %d entries, want 1: %+v", len(got), got)
+	}
+	e := got[0]
+	if e.Event != "applied" || e.System != "Test" || e.RemoteAddr != "192.0.2.1:1234" || e.Time.Before(before.Truncate(time.Second)) {
+		t.Errorf("got %+v", e)
+	}
+	want := []changedLine{{StationID: "cafe", LineID: "red", Index: 0}, {StationID: "cafe", LineID: "blue", Index: 0}}
+	if !slices.Equal(e.Lines, want) {
+		t.Errorf("got lines %+v, want %+v", e.Lines, want)
+	}
+}
+
+func TestUpdateByLineName(t *testing.T) {
+	s := newTestSystem(t)
+	byName := func(id, name string, times ...int) *update {
+		return &update{Stops: []stationUpdate{{StationID: "cafe", Lines: []lineUpdate{{LineID: id, LineName: name, Index: 0, Times: times}}}}}
+	}
+	if _, err := s.processUpdates(byName("", "blue", 6), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.stopMap["cafe"].Lines[0]["blue"].Times; !slices.Equal(got, []int{6}) {
+		t.Errorf("blue by name: got %v, want [6]", got)
+	}
+
+	// The ID wins when both are given
+	if _, err := s.processUpdates(byName("red", "Blue", 2), false); err != nil {
+		t.Fatal(err)
+	}
+	if red, blue := s.stopMap["cafe"].Lines[0]["red"].Times, s.stopMap["cafe"].Lines[0]["blue"].Times; !slices.Equal(red, []int{2}) || !slices.Equal(blue, []int{6}) {
+		t.Errorf("ID and name: got red %v and blue %v, want [2] and [6]", red, blue)
+	}
+
+	if sum, err := s.processUpdates(byName("", "Purple", 1), false); err == nil ||
+		!slices.Equal(sum.Errors, []string{"Invalid line name (Purple) for station cafe, index 0"}) {
+		t.Errorf("unknown name: got %q, %v", sum.Errors, err)
+	}
+}
+
+func TestUpdateByAmbiguousLineName(t *testing.T) {
+	config := strings.Replace(testConfig, `"blue":{"name":"Blue"`, `"blue":{"name":"Red"`, 1)
+	s, err := parseConfig(strings.NewReader(config), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &update{Stops: []stationUpdate{{StationID: "cafe", Lines: []lineUpdate{{LineName: "Red", Index: 0, Times: []int{3}}}}}}
+	sum, err := s.processUpdates(u, false)
+	if err == nil || !slices.Equal(sum.Errors, []string{"Ambiguous line name (Red, 2 lines) for station cafe, index 0"}) {
+		t.Errorf("got %q, %v", sum.Errors, err)
+	}
+	for _, id := range []string{"red", "blue"} {
+		if got := s.stopMap["cafe"].Lines[0][id].Times; len(got) != 0 {
+			t.Errorf("%s was updated to %v", id, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := newTestSystem(t)
+	for _, u := range []*update{lineTimes("cafe", "red", 0, 3, 9), lineTimes("emb", "green", 0, 5)} {
+		if _, err := s.processUpdates(u, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Five lines at stations: red and blue at Café Central one way and
+	// red the other, red at Civic Center and green at the Embarcadero
+	want := systemStats{Stations: 3, Lines: 3, Reporting: 2, AverageTimes: 3.0 / 5}
+	if got := decode[systemStats](t, do(s.handleStats, "GET", "/stats", "")); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsLeavesOutDepartedArrivals(t *testing.T) {
+	s := newTestSystem(t)
+	ln := s.stopMap["cafe"].Lines[0]["red"]
+	ln.Times, ln.TimesAbs, ln.absolute = []int{1}, []int64{time.Now().Unix() - 120}, true
+	if got := decode[systemStats](t, do(s.handleStats, "GET", "/stats", "")); got.Reporting != 0 || got.AverageTimes != 0 {
+		t.Errorf("got %+v, want nothing reporting once the only arrival has gone", got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	setFlag(t, &window, 30)
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 5, 30, 31, 44), false); err != nil {
+		t.Fatal(err)
+	}
+
+	type stop struct {
+		ID    string
+		Lines []map[string]struct {
+			Times   []int
+			Display []string
+		}
+	}
+	info := decode[struct{ Stops []stop }](t, do(s.handleInfo, "GET", "/info", ""))
+	for what, st := range map[string]stop{
+		"/info": info.Stops[0],
+		"/stop": decode[stop](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", "")),
+	} {
+		red := st.Lines[0]["red"]
+		if !slices.Equal(red.Times, []int{5, 30}) || len(red.Display) != 2 {
+			t.Errorf("%s: got %v and %q, want only the times within 30 minutes", what, red.Times, red.Display)
+		}
+	}
+
+	// What is stored is left alone
+	if got := s.stopMap["cafe"].Lines[0]["red"].Times; !slices.Equal(got, []int{5, 30, 31, 44}) {
+		t.Errorf("stored times changed to %v", got)
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	srv := newTestServer(t, newTestSystem(t))
+
+	// Ignored unless allowed
+	resp := fetch(t, srv, "GET", "/stop?id=cafe&callback=show", "")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("without -allowJSONP: got Content-Type %q", ct)
+	}
+
+	setFlag(t, &allowJSONP, true)
+	for _, path := range []string{"/info?callback=$show_1", "/stop?id=cafe&callback=$show_1"} {
+		resp := fetch(t, srv, "GET", path, "")
+		body, _ := io.ReadAll(resp.Body)
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "application/javascript" {
+			t.Errorf("%s: got %d with Content-Type %q", path, resp.StatusCode, ct)
+		}
+		js, ok := strings.CutPrefix(strings.TrimSpace(string(body)), "/**/$show_1(")
+		js, ok2 := strings.CutSuffix(js, ");")
+		if !ok || !ok2 || !json.Valid([]byte(js)) {
+			t.Errorf("%s: got %.80q, want JSON wrapped in $show_1(...)", path, body)
+		}
+	}
+
+	for _, callback := range []string{"alert(1)//", "1st", "a.b", "x%3Balert(1)"} {
+		resp := fetch(t, srv, "GET", "/info?callback="+callback, "")
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusBadRequest || ct == "application/javascript" {
+			t.Errorf("callback %q: got %d with Content-Type %q, want a 400", callback, resp.StatusCode, ct)
+		}
+	}
+}
+
+func TestOutOfService(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	srv := newTestServer(t, newTestSystem(t))
+	infoStops := func() map[string]bool {
+		t.Helper()
+		var info struct {
+			Stops []struct {
+				ID           string
+				OutOfService bool
+			}
+		}
+		if err := json.NewDecoder(fetch(t, srv, "GET", "/info", "").Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		stops := make(map[string]bool)
+		for _, st := range info.Stops {
+			stops[st.ID] = st.OutOfService
+		}
+		return stops
+	}
+	toggle := func(outOfService bool) {
+		t.Helper()
+		body := fmt.Sprintf(`{"stationID":"emb","outOfService":%t}`, outOfService)
+		if resp := fetch(t, srv, "POST", "/station/service", body, "X-API-Key", "sekrit"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("setting outOfService to %t: got %d", outOfService, resp.StatusCode)
+		}
+	}
+
+	if resp := fetch(t, srv, "POST", "/station/service", `{"stationID":"emb","outOfService":true}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the key: got %d, want 401", resp.StatusCode)
+	}
+
+	// Flagged by default
+	toggle(true)
+	if got := infoStops(); !maps.Equal(got, map[string]bool{"cafe": false, "civic": false, "emb": true}) {
+		t.Errorf("out of service: got %v, want emb flagged", got)
+	}
+	toggle(false)
+	if got := infoStops(); !maps.Equal(got, map[string]bool{"cafe": false, "civic": false, "emb": false}) {
+		t.Errorf("back in service: got %v, want nothing flagged", got)
+	}
+
+	// Or left out
+	setFlag(t, &hideOutOfService, true)
+	toggle(true)
+	if got := infoStops(); !maps.Equal(got, map[string]bool{"cafe": false, "civic": false}) {
+		t.Errorf("hidden: got %v, want emb left out", got)
+	}
+}
+
+func TestDisplayTimes(t *testing.T) {
+	if got := displayTimes([]int{0, 1, 5}); !slices.Equal(got, []string{"Due", "1 min", "5 min"}) {
+		t.Errorf("got %q, want Due, 1 min and 5 min", got)
+	}
+	setFlag(t, &dueThreshold, 1)
+	if got := displayTimes([]int{0, 1, 2, 5}); !slices.Equal(got, []string{"Due", "Due", "2 min", "5 min"}) {
+		t.Errorf("with -dueThreshold=1: got %q", got)
+	}
+
+	// Shown alongside the times they come from
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 1, 5), false); err != nil {
+		t.Fatal(err)
+	}
+	stop := decode[struct {
+		Lines []map[string]struct {
+			Times   []int
+			Display []string
+		}
+	}](t, do(s.handleStopInfo, "GET", "/stop?id=cafe", ""))
+	red := stop.Lines[0]["red"]
+	if !slices.Equal(red.Times, []int{1, 5}) || !slices.Equal(red.Display, []string{"Due", "5 min"}) {
+		t.Errorf("/stop: got %v shown as %q", red.Times, red.Display)
+	}
+}
+
+func TestCoalesceKeepsLatestTimes(t *testing.T) {
+	setFlag(t, &coalesceWindow, time.Hour)
+	setFlag(t, &caseInsensitiveIDs, true)
+	s := newTestSystem(t)
+	for _, body := range []string{
+		`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[9]},{"lineID":"blue","index":0,"times":[6]}]}]}`,
+		`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[8,3]}]}]}`,
+		`{"stops":[{"stationID":"CAFE","lines":[{"lineID":"Red","index":0,"times":[4]}]}]}`,
+		`{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":1,"times":[7]}]}]}`,
+	} {
+		if sum := decode[updateSummary](t, do(s.handleUpdate, "POST", "/update", body)); !sum.Queued {
+			t.Fatalf("%s wasn't queued", body)
+		}
+	}
+	if got := s.stopMap["cafe"].Lines[0]["red"].Times; len(got) != 0 {
+		t.Fatalf("applied before the window closed: %v", got)
+	}
+
+	// Cancelled straight away, the coalescer just flushes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.coalesce(ctx, time.Hour)
+
+	for _, tc := range []struct {
+		lineID string
+		index  int
+		want   []int
+	}{
+		{"red", 0, []int{4}},
+		{"blue", 0, []int{6}},
+		{"red", 1, []int{7}},
+	} {
+		if got := s.stopMap["cafe"].Lines[tc.index][tc.lineID].Times; !slices.Equal(got, tc.want) {
+			t.Errorf("%s in direction %d: got %v, want %v", tc.lineID, tc.index, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkCoalesce(b *testing.B) {
+	// A burst of tiny updates, ten to each line
+	const stations, burst = 10, 200
+	updates := make([]*update, burst)
+	for i := range updates {
+		updates[i] = lineTimes(fmt.Sprintf("s%d", i%stations), "red", 0, i%30+1, i%30+5)
+	}
+
+	b.Run("individually", func(b *testing.B) {
+		s := benchSystem(b, stations)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, u := range updates {
+				if _, err := s.processUpdates(u, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		s := benchSystem(b, stations)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, u := range updates {
+				s.buffer(u)
+			}
+			s.bufferMu.Lock()
+			stops := s.buffered
+			s.buffered = nil
+			s.bufferMu.Unlock()
+			if _, err := s.processUpdates(coalesced(stops), false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	srv := newTestServer(t, newTestSystem(t))
+	logs := captureLogs(t)
+	slog.SetDefault(slog.New(requestIDHandler{slog.Default().Handler()}))
+
+	// The proxy's ID is kept, and logged by the handler as well as the
+	// access log
+	resp := fetch(t, srv, "POST", "/update", `{"stops":[{"stationID":"nowhere","lines":[]}]}`, "X-Request-ID", "proxy-123")
+	if got := resp.Header.Get("X-Request-ID"); got != "proxy-123" {
+		t.Errorf("got X-Request-ID %q, want the inbound proxy-123", got)
+	}
+	for _, msg := range []string{"msg=Request ", `msg="Rejected update"`} {
+		if !slices.ContainsFunc(strings.Split(logs.String(), "\n"), func(line string) bool {
+			return strings.Contains(line, msg) && strings.Contains(line, "requestID=proxy-123")
+		}) {
+			t.Errorf("no %s logged with the request ID in %q", msg, logs)
+		}
+	}
+
+	// Otherwise each request gets its own
+	seen := make(map[string]bool)
+	for _, inbound := range []string{"", "", strings.Repeat("x", maxRequestID+1), "with spaces", "ünicode"} {
+		resp := fetch(t, srv, "GET", "/info", "", "X-Request-ID", inbound)
+		id := resp.Header.Get("X-Request-ID")
+		if len(id) != 32 || seen[id] {
+			t.Errorf("inbound %q: got X-Request-ID %q, want a new random one", inbound, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestAddStation(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	pier := `{"name":"Pier 39","id":"pier","coord":{"lat":37.808,"lon":-122.41},"directions":["In","Out"],"lines":[{"f":{"name":"F","id":"f","color":"#f0e68c"}},{}]}`
+
+	if resp := fetch(t, srv, "POST", "/station", pier); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the key: got %d, want 401", resp.StatusCode)
+	}
+	if resp := fetch(t, srv, "POST", "/station", pier, "X-API-Key", "sekrit"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d, want 201", resp.StatusCode)
+	}
+
+	resp := fetch(t, srv, "GET", "/stop?id=pier", "")
+	var stop stationSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&stop); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("/stop: got %d, %v", resp.StatusCode, err)
+	}
+	if f := stop.Lines[0]["f"]; stop.Name != "Pier 39" || f == nil || f.Times == nil || len(f.Times) != 0 {
+		t.Errorf("/stop: got %q with lines %+v", stop.Name, stop.Lines)
+	}
+
+	// It takes updates like any other
+	if _, err := s.processUpdates(lineTimes("pier", "f", 0, 4), false); err != nil {
+		t.Error(err)
+	}
+
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"duplicate", pier, http.StatusConflict},
+		{"existing", `{"name":"Again","id":"cafe","coord":{"lat":37.78,"lon":-122.41},"directions":["N","S"],"lines":[{},{}]}`, http.StatusConflict},
+		{"invalid", `{"name":"Nowhere","id":"nowhere","coord":{"lat":137,"lon":-122.41},"directions":["N","S"],"lines":[{},{}]}`, http.StatusBadRequest},
+		{"malformed", `{"id":`, http.StatusBadRequest},
+		{"updatedAt", `{"name":"Pier 41","id":"pier41","coord":{"lat":37.808,"lon":-122.41},"directions":["In","Out"],"lines":[{"f":{"name":"F","id":"f","color":"#f0e68c","updatedAt":"2026-01-01T00:00:00Z"}},{}]}`, http.StatusBadRequest},
+	} {
+		if resp := fetch(t, srv, "POST", "/station", tc.body, "X-API-Key", "sekrit"); resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+	if len(s.Stops) != 4 {
+		t.Errorf("got %d stations, want 4", len(s.Stops))
+	}
+}
+
+func TestRemoveStation(t *testing.T) {
+	setFlag(t, &updateKey, "sekrit")
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	gone, kept := s.subscribe("emb"), s.subscribe("cafe")
+
+	if resp := fetch(t, srv, "DELETE", "/station?id=emb", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the key: got %d, want 401", resp.StatusCode)
+	}
+	if resp := fetch(t, srv, "DELETE", "/station?id=emb", "", "X-API-Key", "sekrit"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %d, want 204", resp.StatusCode)
+	}
+
+	if resp := fetch(t, srv, "GET", "/stop?id=emb", ""); resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/stop for the removed station: got %d, want 400 or 404", resp.StatusCode)
+	}
+	if !closed(gone) {
+		t.Error("stream following the removed station left open")
+	}
+	if closed(kept) {
+		t.Error("stream following a remaining station closed")
+	}
+	if len(s.Stops) != 2 {
+		t.Errorf("got %d stations, want 2", len(s.Stops))
+	}
+
+	if resp := fetch(t, srv, "DELETE", "/station?id=emb", "", "X-API-Key", "sekrit"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("removing it again: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAPIVersion1(t *testing.T) {
+	s := newTestSystem(t)
+	if _, err := s.processUpdates(lineTimes("cafe", "red", 0, 3), false); err != nil {
+		t.Fatal(err)
+	}
+	get := func(h http.HandlerFunc, target, accept string) map[string]any {
+		t.Helper()
+		r := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return decode[map[string]any](t, w)
+	}
+
+	// Only the original fields, all the way down
+	stationFields := []string{"coord", "directions", "id", "lines", "name"}
+	lineFields := []string{"color", "id", "name", "times"}
+	checkStation := func(what string, stop map[string]any) {
+		t.Helper()
+		if got := slices.Sorted(maps.Keys(stop)); !slices.Equal(got, stationFields) {
+			t.Errorf("%s: got station fields %q, want %q", what, got, stationFields)
+		}
+		red := stop["lines"].([]any)[0].(map[string]any)["red"].(map[string]any)
+		if got := slices.Sorted(maps.Keys(red)); !slices.Equal(got, lineFields) {
+			t.Errorf("%s: got line fields %q, want %q", what, got, lineFields)
+		}
+	}
+	check := func(what, accept string) {
+		t.Helper()
+		info := get(s.handleInfo, "/info", accept)
+		if got, want := slices.Sorted(maps.Keys(info)), []string{"name", "stops", "tagline", "timeMax"}; !slices.Equal(got, want) {
+			t.Errorf("%s /info: got fields %q, want %q", what, got, want)
+		}
+		checkStation(what+" /info", info["stops"].([]any)[0].(map[string]any))
+		checkStation(what+" /stop", get(s.handleStopInfo, "/stop?id=cafe", accept))
+	}
+
+	check("asked for", "application/vnd.transit.v1+json")
+	setFlag(t, &apiVersion, 1)
+	check("by default", "")
+
+	// Clients can still ask for the new fields
+	stop := get(s.handleStopInfo, "/stop?id=cafe", "application/vnd.transit.v2+json")
+	red := stop["lines"].([]any)[0].(map[string]any)["red"].(map[string]any)
+	for _, field := range []string{"display", "destination", "updatedAt"} {
+		if _, ok := red[field]; !ok {
+			t.Errorf("v2 asked for: no %s in %v", field, red)
+		}
+	}
+	if _, ok := stop["lineOrder"]; !ok {
+		t.Errorf("v2 asked for: no lineOrder in %v", stop)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	setFlag(t, &idempotencyKeys, newIdempotencyCache(time.Minute, 10))
+	entries := tempAuditLog(t)
+	s := newTestSystem(t)
+	srv := newTestServer(t, s)
+	sub := s.subscribe("")
+	<-sub.events
+
+	// The retry gets the first response, without applying it again
+	body := `{"stops":[{"stationID":"cafe","lines":[{"lineID":"red","index":0,"times":[3]}]}]}`
+	first := fetch(t, srv, "POST", "/update", body, "Idempotency-Key", "retry-1")
+	firstBody, _ := io.ReadAll(first.Body)
+	retry := fetch(t, srv, "POST", "/update", body, "Idempotency-Key", "retry-1")
+	retryBody, _ := io.ReadAll(retry.Body)
+	if first.StatusCode != http.StatusOK || retry.StatusCode != http.StatusOK || !bytes.Equal(firstBody, retryBody) {
+		t.Errorf("got %d %s then %d %s, want the same response twice", first.StatusCode, firstBody, retry.StatusCode, retryBody)
+	}
+	if first.Header.Get("Idempotent-Replayed") != "" || retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Idempotent-Replayed %q then %q, want only the retry marked", first.Header.Get("Idempotent-Replayed"), retry.Header.Get("Idempotent-Replayed"))
+	}
+
+	// Another key is another update
+	fetch(t, srv, "POST", "/update", strings.Replace(body, "[3]", "[4]", 1), "Idempotency-Key", "retry-2")
+
+	if got := entries(); len(got) != 2 {
+		t.Errorf("got %d audit entries, want one for each key: %+v", len(got), got)
+	}
+	deltas := 0
+	for len(sub.events) > 0 {
+		if e := <-sub.events; e.kind == "delta" {
+			deltas++
+		}
+	}
+	if deltas != 2 {
+		t.Errorf("got %d stream deltas, want one for each key", deltas)
+	}
+}
+
+func TestIdempotencyCacheEviction(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 2)
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		resp, claimed := c.claim(key, now)
+		if !claimed {
+			t.Fatalf("%s: already claimed", key)
+		}
+		c.finish(resp, http.StatusOK, "application/json", []byte("{}"))
+	}
+
+	// Seen keys are remembered until they expire
+	if _, claimed := c.claim("a", now.Add(time.Second)); claimed {
+		t.Error("a claimed again before expiring")
+	}
+
+	// Past the limit, the least recently seen goes
+	resp, _ := c.claim("c", now.Add(2*time.Second))
+	c.finish(resp, http.StatusOK, "application/json", []byte("{}"))
+	if _, claimed := c.claim("a", now.Add(3*time.Second)); claimed {
+		t.Error("a, seen most recently, was evicted")
+	}
+	if resp, claimed := c.claim("b", now.Add(3*time.Second)); !claimed {
+		t.Error("b wasn't evicted")
+	} else {
+		c.finish(resp, http.StatusOK, "application/json", []byte("{}"))
+	}
+
+	// And keys expire after the TTL
+	if _, claimed := c.claim("a", now.Add(time.Minute+time.Second)); !claimed {
+		t.Error("a still remembered after the TTL")
+	}
+
+	// Failed attempts aren't remembered
+	resp, _ = c.claim("failed", now)
+	c.finish(resp, http.StatusBadRequest, "application/json", []byte("{}"))
+	if _, claimed := c.claim("failed", now); !claimed {
+		t.Error("a failed attempt was remembered")
+	}
+}
+
+func TestDefineFlagsResetsSettings(t *testing.T) {
+	setFlag(t, &staticDirectory, staticDirectory)
+	setFlag(t, &cacheControl, cacheControl)
+	setFlag(t, &maxTimes, 3)
+	setFlag(t, &expiredThreshold, 2)
+	setFlag(t, &staleThreshold, time.Minute)
+	setFlag(t, &corsOrigins, []string{"https://kiosk.example"})
+	setFlag(t, &webhooks, []*webhook{newWebhook("http://127.0.0.1/hook")})
+	setFlag(t, &apiVersion, 1)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := defineFlags(fs)
+	if err := fs.Parse([]string{"-cacheControl=max-age=5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if maxTimes != 10 || expiredThreshold != 0 || staleThreshold != 0 || corsOrigins != nil || webhooks != nil || apiVersion != 2 {
+		t.Errorf("maxTimes %d, expiredThreshold %d, staleThreshold %v, corsOrigins %v, webhooks %v, apiVersion %d; want the defaults",
+			maxTimes, expiredThreshold, staleThreshold, corsOrigins, webhooks, apiVersion)
+	}
+	if cacheControl != "max-age=5" {
+		t.Errorf("cacheControl = %q, want the flag's", cacheControl)
+	}
+}
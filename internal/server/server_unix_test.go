@@ -0,0 +1,73 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	// Socket paths are short, so not under t.TempDir
+	dir, err := os.MkdirTemp("", "ltdiy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "ltdiy.sock")
+
+	// A socket left behind by a server that crashed is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socket); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %v, want 0660", info.Mode().Perm())
+	}
+	routeTestSystem(t, newTestSystem(t))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://ltdiy/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info struct{ Name string }
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || resp.StatusCode != http.StatusOK || info.Name != "Test" {
+		t.Errorf("got %d with name %q, %v", resp.StatusCode, info.Name, err)
+	}
+
+	// Anything else at the path is left alone
+	other := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(other, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenUnix(other); err == nil {
+		l.Close()
+		t.Error("listened over a regular file")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("the regular file was removed: %v", err)
+	}
+}